@@ -41,6 +41,15 @@ run_warn "running ${DB_NAME}_test migrations" "$MIGCMD $PSQL -d ${DB_NAME}_test
 	"database migrations failed" \
 	"if the database has already been migrated, you can ignore this message"
 
+# record the newest migration as the schema version, see dt.SchemaVersion
+SCHEMA_VERSION=$(ls db/migrations/up/*.sql | sort | tail -n 1 | xargs basename | cut -d_ -f1)
+SETVERCMD="UPDATE schemaversion SET version=$SCHEMA_VERSION"
+run_warn "recording $DB_NAME schema version" "$PSQL -d $DB_NAME -c '$SETVERCMD'" \
+	"failed to record the schema version"
+
+run_warn "recording ${DB_NAME}_test schema version" "$PSQL -d ${DB_NAME}_test -c '$SETVERCMD'" \
+	"failed to record the schema version"
+
 CITY_CNT=$(wc -l data/cities.csv | awk '{print $1}')
 SEEDA="cat data/cities.csv | $PSQL"
 SEEDB="COPY cities(name, countrycode) FROM stdin DELIMITER ',' CSV;"
@@ -0,0 +1,2 @@
+DROP TABLE phoneverifications;
+ALTER TABLE userflexids DROP COLUMN verified;
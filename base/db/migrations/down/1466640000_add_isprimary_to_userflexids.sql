@@ -0,0 +1 @@
+ALTER TABLE userflexids DROP COLUMN isprimary;
@@ -0,0 +1,2 @@
+-- The original case of email flexids isn't kept, so there's nothing to
+-- restore.
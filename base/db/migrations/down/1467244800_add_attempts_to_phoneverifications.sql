@@ -0,0 +1 @@
+ALTER TABLE phoneverifications DROP COLUMN attempts;
@@ -0,0 +1 @@
+DROP INDEX userflexids_userid_flexid_flexidtype_idx;
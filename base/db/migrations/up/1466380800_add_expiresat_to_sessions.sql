@@ -0,0 +1 @@
+ALTER TABLE sessions ADD COLUMN expiresat TIMESTAMP;
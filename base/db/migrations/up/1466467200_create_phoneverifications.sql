@@ -0,0 +1,12 @@
+ALTER TABLE userflexids ADD COLUMN verified BOOLEAN NOT NULL DEFAULT FALSE;
+-- Existing flexids predate verification, so keep them usable.
+UPDATE userflexids SET verified=TRUE;
+
+CREATE TABLE phoneverifications (
+	userid INTEGER NOT NULL,
+	flexid VARCHAR(255) NOT NULL,
+	code VARCHAR(255) NOT NULL,
+	expiresat TIMESTAMP NOT NULL,
+	createdat TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	PRIMARY KEY (userid, flexid)
+);
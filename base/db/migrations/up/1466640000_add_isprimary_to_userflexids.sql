@@ -0,0 +1 @@
+ALTER TABLE userflexids ADD COLUMN isprimary BOOLEAN NOT NULL DEFAULT FALSE;
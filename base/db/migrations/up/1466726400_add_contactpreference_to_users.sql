@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN contactpreference INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,8 @@
+CREATE TABLE idempotencykeys (
+	userid INTEGER NOT NULL,
+	idempotencykey VARCHAR(255) NOT NULL,
+	resourceid INTEGER NOT NULL,
+	expiresat TIMESTAMP NOT NULL,
+	createdat TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	PRIMARY KEY (userid, idempotencykey)
+);
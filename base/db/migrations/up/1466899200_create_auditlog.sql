@@ -0,0 +1,9 @@
+CREATE TABLE auditlog (
+	id SERIAL,
+	userid INTEGER NOT NULL,
+	action VARCHAR(255) NOT NULL,
+	entityid INTEGER NOT NULL,
+	createdat TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	PRIMARY KEY (id)
+);
+CREATE INDEX auditlog_userid_idx ON auditlog (userid);
@@ -0,0 +1,7 @@
+CREATE TABLE userprefs (
+	userid INTEGER NOT NULL,
+	key VARCHAR(255) NOT NULL,
+	value TEXT NOT NULL,
+	createdat TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	PRIMARY KEY (userid, key)
+);
@@ -0,0 +1,3 @@
+-- Email flexids are matched exactly against their lowercased form, so
+-- lowercase any saved before User.Create normalized them.
+UPDATE userflexids SET flexid=LOWER(flexid) WHERE flexidtype=1;
@@ -0,0 +1 @@
+ALTER TABLE phoneverifications ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;
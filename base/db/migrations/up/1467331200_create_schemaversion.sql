@@ -0,0 +1,6 @@
+-- The version is the timestamp of the newest migration applied, and it's
+-- updated after migrations are run. See dt.SchemaVersion.
+CREATE TABLE schemaversion (
+	version BIGINT NOT NULL
+);
+INSERT INTO schemaversion (version) VALUES (1467331200);
@@ -0,0 +1,16 @@
+-- Duplicate rows are copies of the same flexid saved by concurrent calls to
+-- User.AddFlexID, so fold their flags into the oldest copy and drop the rest.
+UPDATE userflexids SET verified=d.verified, isprimary=d.isprimary
+FROM (
+	SELECT MIN(id) AS id, BOOL_OR(verified) AS verified,
+		BOOL_OR(isprimary) AS isprimary
+	FROM userflexids
+	GROUP BY userid, flexid, flexidtype
+	HAVING COUNT(*) > 1
+) d
+WHERE userflexids.id=d.id;
+DELETE FROM userflexids f USING userflexids o
+WHERE f.userid=o.userid AND f.flexid=o.flexid AND f.flexidtype=o.flexidtype
+	AND f.id > o.id;
+CREATE UNIQUE INDEX userflexids_userid_flexid_flexidtype_idx
+	ON userflexids (userid, flexid, flexidtype);
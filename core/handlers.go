@@ -176,8 +176,9 @@ func hapiLoginSubmit(w http.ResponseWriter, r *http.Request) {
 		ID       uint64
 		Password []byte
 		Admin    bool
+		Disabled bool
 	}
-	q := `SELECT id, password, admin FROM users WHERE email=$1`
+	q := `SELECT id, password, admin, disabled FROM users WHERE email=$1`
 	err := db.Get(&u, q, req.Email)
 	if err == sql.ErrNoRows {
 		writeErrorAuth(w, ErrInvalidUserPass)
@@ -198,6 +199,10 @@ func hapiLoginSubmit(w http.ResponseWriter, r *http.Request) {
 		writeErrorInternal(w, err)
 		return
 	}
+	if u.Disabled {
+		writeErrorAuth(w, errors.New("This account has been disabled."))
+		return
+	}
 	user := &dt.User{
 		ID:    u.ID,
 		Email: req.Email,
@@ -256,9 +261,7 @@ func hapiSignupSubmit(w http.ResponseWriter, r *http.Request) {
 		writeErrorBadRequest(w, errors.New("You must enter a name."))
 		return
 	}
-	if len(req.Email) == 0 ||
-		!strings.ContainsAny(req.Email, "@") ||
-		!strings.ContainsAny(req.Email, ".") {
+	if !dt.ValidEmail(req.Email) {
 		writeErrorBadRequest(w, errors.New("You must enter a valid email."))
 		return
 	}
@@ -307,6 +310,14 @@ func hapiSignupSubmit(w http.ResponseWriter, r *http.Request) {
 		Admin:    admin,
 	}
 	err := user.Create(db, dt.FlexIDType(2), req.FID)
+	if err == dt.ErrUserExists {
+		writeErrorBadRequest(w, errors.New("That email is already registered. Please log in instead."))
+		return
+	}
+	if err == dt.ErrDisposableEmail {
+		writeErrorBadRequest(w, errors.New("Please sign up with a permanent email address."))
+		return
+	}
 	if err != nil {
 		writeErrorInternal(w, err)
 		return
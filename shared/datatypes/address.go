@@ -1,6 +1,10 @@
 package dt
 
-import "errors"
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
 
 // Address holds all relevant information in an address for presentation to the
 // user and communication to external services, including the USPS address
@@ -22,3 +26,121 @@ type Address struct {
 
 // ErrNoAddress signals that no address could be found when one was expected.
 var ErrNoAddress = errors.New("no address")
+
+// AddressError is returned when validating an address, listing every invalid
+// field.
+type AddressError struct {
+	Fields []string
+}
+
+// Error lists the invalid fields.
+func (e *AddressError) Error() string {
+	return "invalid address: " + strings.Join(e.Fields, ", ")
+}
+
+// regexUSZip matches 5 and 9 digit U.S. zip codes, e.g. 90210 or 90210-1234.
+var regexUSZip = regexp.MustCompile(`^[0-9]{5}(-?[0-9]{4})?$`)
+
+// Validate ensures the address has the fields needed to deliver to it,
+// returning an *AddressError listing every invalid field. Zip codes are
+// validated only for U.S. addresses. Addresses without a country are treated
+// as U.S. addresses.
+func (a *Address) Validate() error {
+	var fields []string
+	if strings.TrimSpace(a.Line1) == "" {
+		fields = append(fields, "Line1")
+	}
+	if strings.TrimSpace(a.City) == "" {
+		fields = append(fields, "City")
+	}
+	if a.isUS() && !regexUSZip.MatchString(strings.TrimSpace(a.Zip)) {
+		fields = append(fields, "Zip")
+	}
+	if len(fields) > 0 {
+		return &AddressError{Fields: fields}
+	}
+	return nil
+}
+
+// isUS reports whether the address is in the United States.
+func (a *Address) isUS() bool {
+	switch strings.ToUpper(strings.TrimSpace(a.Country)) {
+	case "", "US", "USA":
+		return true
+	}
+	return false
+}
+
+// addressAbbreviations maps common address words to their USPS abbreviations,
+// so that e.g. "Street" and "St." produce the same Key.
+var addressAbbreviations = map[string]string{
+	"street":    "st",
+	"avenue":    "ave",
+	"av":        "ave",
+	"road":      "rd",
+	"boulevard": "blvd",
+	"drive":     "dr",
+	"lane":      "ln",
+	"court":     "ct",
+	"place":     "pl",
+	"terrace":   "ter",
+	"parkway":   "pkwy",
+	"highway":   "hwy",
+	"circle":    "cir",
+	"square":    "sq",
+	"north":     "n",
+	"south":     "s",
+	"east":      "e",
+	"west":      "w",
+	"apartment": "apt",
+	"#":         "apt",
+	"suite":     "ste",
+	"unit":      "apt",
+}
+
+// regexAddressNonWord matches runs of characters dropped from an address Key.
+var regexAddressNonWord = regexp.MustCompile(`[^a-z0-9#]+`)
+
+// Key returns a canonical form of the address for detecting that two
+// addresses are the same place. Case, punctuation and spacing are ignored,
+// common words such as "Street" and "Apartment" are abbreviated, and only the
+// first five digits of U.S. zip codes are compared. Name and DisplayAddress
+// are not part of the Key.
+func (a *Address) Key() string {
+	zip := strings.ToLower(strings.TrimSpace(a.Zip))
+	country := strings.ToLower(strings.TrimSpace(a.Country))
+	if a.isUS() {
+		if a.Zip5 != "" {
+			zip = a.Zip5
+		} else if len(zip) > 5 {
+			zip = zip[:5]
+		}
+		country = "us"
+	}
+	return strings.Join([]string{
+		normalizeAddressField(a.Line1 + " " + a.Line2),
+		normalizeAddressField(a.City),
+		normalizeAddressField(a.State),
+		zip,
+		country,
+	}, "|")
+}
+
+// normalizeAddressField lowercases s, strips punctuation and abbreviates common
+// address words. Repeated unit designators, as in "Apt #4", are collapsed.
+func normalizeAddressField(s string) string {
+	s = strings.ToLower(s)
+	s = strings.Replace(s, "#", " # ", -1)
+	words := strings.Fields(regexAddressNonWord.ReplaceAllString(s, " "))
+	out := make([]string, 0, len(words))
+	for _, w := range words {
+		if abbr, ok := addressAbbreviations[w]; ok {
+			w = abbr
+		}
+		if len(out) > 0 && w == "apt" && out[len(out)-1] == "apt" {
+			continue
+		}
+		out = append(out, w)
+	}
+	return strings.Join(out, " ")
+}
@@ -0,0 +1,103 @@
+package dt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAddressValidate(t *testing.T) {
+	valid := Address{
+		Line1:   "100 Penn St.",
+		City:    "Los Angeles",
+		State:   "CA",
+		Zip:     "90000",
+		Country: "USA",
+	}
+	tests := map[string]struct {
+		update func(a *Address)
+		fields []string
+	}{
+		"valid":         {func(a *Address) {}, nil},
+		"zip+4":         {func(a *Address) { a.Zip = "90000-1234" }, nil},
+		"zip9":          {func(a *Address) { a.Zip = "900001234" }, nil},
+		"no country":    {func(a *Address) { a.Country = "" }, nil},
+		"missing line1": {func(a *Address) { a.Line1 = " " }, []string{"Line1"}},
+		"missing city":  {func(a *Address) { a.City = "" }, []string{"City"}},
+		"missing zip":   {func(a *Address) { a.Zip = "" }, []string{"Zip"}},
+		"short zip":     {func(a *Address) { a.Zip = "9000" }, []string{"Zip"}},
+		"alpha zip":     {func(a *Address) { a.Zip = "9000A" }, []string{"Zip"}},
+		"8 digit zip":   {func(a *Address) { a.Zip = "90000123" }, []string{"Zip"}},
+		"all": {
+			func(a *Address) { *a = Address{} },
+			[]string{"Line1", "City", "Zip"},
+		},
+		"non-US postcode": {func(a *Address) {
+			a.Country = "GBR"
+			a.Zip = "SW1A 1AA"
+		}, nil},
+		"non-US missing city": {func(a *Address) {
+			a.Country = "CAN"
+			a.Zip = ""
+			a.City = ""
+		}, []string{"City"}},
+	}
+	for name, test := range tests {
+		a := valid
+		test.update(&a)
+		err := a.Validate()
+		if test.fields == nil {
+			if err != nil {
+				t.Fatalf("%s: expected valid, got %s", name, err)
+			}
+			continue
+		}
+		aerr, ok := err.(*AddressError)
+		if !ok {
+			t.Fatalf("%s: expected *AddressError, got %v", name, err)
+		}
+		if !reflect.DeepEqual(aerr.Fields, test.fields) {
+			t.Fatalf("%s: expected %v, got %v", name, test.fields,
+				aerr.Fields)
+		}
+	}
+}
+
+func TestAddressKey(t *testing.T) {
+	a := Address{
+		Line1: "100 North Penn Street",
+		Line2: "Apartment 4",
+		City:  "Los Angeles",
+		State: "CA",
+		Zip:   "90000-1234",
+	}
+	same := []Address{
+		{Line1: "100 N. Penn St., Apt #4", City: "los angeles",
+			State: "ca", Zip: "90000", Country: "USA"},
+		{Line1: "100 n penn st", Line2: "#4", City: "Los  Angeles",
+			State: "CA", Zip5: "90000", Zip: "900001234"},
+		{Name: "Home", Line1: " 100 NORTH PENN ST ", Line2: "Unit 4",
+			City: "Los Angeles", State: "CA", Zip: "90000", Country: "US"},
+	}
+	for _, b := range same {
+		if a.Key() != b.Key() {
+			t.Fatalf("expected %q, got %q", a.Key(), b.Key())
+		}
+	}
+	different := []Address{
+		{Line1: "100 Penn St", Line2: "Apt 4", City: "Los Angeles",
+			State: "CA", Zip: "90000"},
+		{Line1: "100 N Penn St", Line2: "Apt 5", City: "Los Angeles",
+			State: "CA", Zip: "90000"},
+		{Line1: "100 N Penn Ave", Line2: "Apt 4", City: "Los Angeles",
+			State: "CA", Zip: "90000"},
+		{Line1: "100 N Penn St", Line2: "Apt 4", City: "Los Angeles",
+			State: "CA", Zip: "90001"},
+		{Line1: "100 N Penn St", Line2: "Apt 4", City: "Los Angeles",
+			State: "CA", Zip: "90000", Country: "CAN"},
+	}
+	for _, b := range different {
+		if a.Key() == b.Key() {
+			t.Fatalf("expected %+v to differ from %+v", b, a)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package dt
+
+import (
+	"fmt"
+	"time"
+)
+
+// AuditAction identifies a change to a user's payment data recorded in their
+// AuditLog.
+type AuditAction string
+
+// AuditActions are the changes recorded in the audit log. The EntityID of each
+// AuditEntry is the ID of the card involved.
+const (
+	AuditCardAdded   AuditAction = "card.added"
+	AuditCardDeleted AuditAction = "card.deleted"
+)
+
+// AuditEntry records a single change to a user's payment data, e.g. for
+// resolving disputes. Entries are never updated, and they're kept after the
+// user or card is deleted.
+type AuditEntry struct {
+	ID        uint64
+	UserID    uint64
+	Action    AuditAction
+	EntityID  uint64
+	CreatedAt time.Time
+}
+
+// AuditLog returns up to limit of the user's most recent audit entries, newest
+// first. Limits above MaxPageSize are reduced to MaxPageSize.
+func (u *User) AuditLog(db Queryer, limit int) (_ []AuditEntry, err error) {
+	defer observe("User.AuditLog", time.Now(), &err)
+	if limit < 1 {
+		return nil, ErrInvalidPage
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+	entries := []AuditEntry{}
+	q := `SELECT id, userid, action, entityid, createdat FROM auditlog
+	      WHERE userid=$1
+	      ORDER BY createdat DESC, id DESC
+	      LIMIT $2`
+	if err = db.Select(&entries, q, u.ID, limit); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// audit appends an entry to the user's audit log. It should be called with
+// the transaction making the change, so the two can't diverge.
+func audit(tx Queryer, uid uint64, action AuditAction, entityID uint64) error {
+	q := `INSERT INTO auditlog (userid, action, entityid) VALUES ($1, $2, $3)`
+	if _, err := tx.Exec(q, uid, action, entityID); err != nil {
+		return fmt.Errorf("audit %s: %s", action, err)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package dt
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestAuditLog(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	other := seedUser(t, "u@example.com")
+	c := seedCard(t, u, "4242")
+	seedCard(t, other, "1111")
+	entries, err := u.AuditLog(testDB, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Action != AuditCardAdded ||
+		entries[0].EntityID != uint64(c.ID) || entries[0].UserID != u.ID {
+		t.Fatal("expected 1 card.added entry, got", entries)
+	}
+
+	replacement := &Card{Last4: "4444", CardholderName: u.Name, ExpMonth: 9,
+		ExpYear: 2031, Brand: "MasterCard", ServiceToken: "tok_4444"}
+	if _, err = u.ReplaceCard(testDB, uint64(c.ID), replacement); err != nil {
+		t.Fatal(err)
+	}
+	if err = u.DeleteCard(testDB, uint64(c.ID)); err != ErrCardNotFound {
+		t.Fatal("expected ErrCardNotFound, got", err)
+	}
+	entries, err = u.AuditLog(testDB, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		action AuditAction
+		id     int
+	}{
+		{AuditCardDeleted, c.ID},
+		{AuditCardAdded, replacement.ID},
+		{AuditCardAdded, c.ID},
+	}
+	if len(entries) != len(expected) {
+		t.Fatal("expected", len(expected), "entries, got", entries)
+	}
+	for i, e := range expected {
+		if entries[i].Action != e.action ||
+			entries[i].EntityID != uint64(e.id) {
+			t.Fatalf("entry %d: expected %s %d, got %+v", i, e.action,
+				e.id, entries[i])
+		}
+	}
+	entries, err = u.AuditLog(testDB, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Action != AuditCardDeleted {
+		t.Fatal("expected only the newest entry, got", entries)
+	}
+}
+
+func TestAuditLogRolledBack(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	errRollback := errors.New("rollback")
+	err := WithTx(testDB, func(tx *sqlx.Tx) error {
+		c := &Card{Last4: "4242", CardholderName: u.Name, ExpMonth: 8,
+			ExpYear: 2030, Brand: "Visa", ServiceToken: "tok_4242"}
+		if _, err := u.AddCard(tx, c); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if err != errRollback {
+		t.Fatal("expected errRollback, got", err)
+	}
+	entries, err := u.AuditLog(testDB, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatal("expected audit entry to be rolled back, got", entries)
+	}
+}
@@ -0,0 +1,180 @@
+package dt
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// MaxUserCacheEntries is the most entries a UserCache holds. Once full, the
+// least recently used entry is evicted to make room for each new one.
+const MaxUserCacheEntries = 10000
+
+// UserCache holds users loaded by GetUserCached for up to a fixed TTL, saving
+// repeated queries for the same user within a conversation. It holds at most
+// MaxUserCacheEntries entries. It's safe for concurrent use.
+//
+// Caching is opt-in, since cached users may be stale. Changes to a user or
+// their flexids made through this package, or a call to Reload, evict the
+// user from every UserCache in this process. Changes made any other way, such
+// as by another server or directly in the database, are seen only once the
+// TTL expires, so the TTL should be short.
+type UserCache struct {
+	ttl time.Duration
+	max int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // of *userCacheEntry, most recently used first
+}
+
+// userCacheEntry is a cached user, the key under which it's cached and the
+// time at which it expires.
+type userCacheEntry struct {
+	key       string
+	user      User
+	expiresAt time.Time
+}
+
+// userCaches tracks every UserCache so that changes to a user can evict them
+// from all caches.
+var userCaches struct {
+	sync.Mutex
+	caches []*UserCache
+}
+
+// NewUserCache returns an empty UserCache holding users for ttl. The cache is
+// never garbage collected, so it should be created once and reused.
+func NewUserCache(ttl time.Duration) *UserCache {
+	c := &UserCache{
+		ttl:     ttl,
+		max:     MaxUserCacheEntries,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+	userCaches.Lock()
+	userCaches.caches = append(userCaches.caches, c)
+	userCaches.Unlock()
+	return c
+}
+
+// GetUserCached is the same as GetUser, except that users are served from the
+// cache when present and added to it when loaded from db. As with GetUser, a
+// request by FlexID is normalized in place, so differently formatted FlexIDs
+// share a cache entry. Unregistered users are never cached. A nil cache
+// always queries db.
+func GetUserCached(c *UserCache, db Queryer, req *Request) (*User, error) {
+	if c == nil {
+		return GetUser(db, req)
+	}
+	key := fmt.Sprintf("id:%d", req.UserID)
+	if req.UserID == 0 {
+		if err := normalizeRequest(req); err != nil {
+			return nil, err
+		}
+		key = flexIDCacheKey(req.FlexID, req.FlexIDType)
+	}
+	if u, ok := c.get(key); ok {
+		if req.UserID == 0 {
+			req.UserID = u.ID
+		} else {
+			u.FlexID, u.FlexIDType = req.FlexID, req.FlexIDType
+		}
+		return u, nil
+	}
+	u, err := GetUser(db, req)
+	if err != nil {
+		return nil, err
+	}
+	if u.ID > 0 {
+		c.set(key, u)
+	}
+	return u, nil
+}
+
+// flexIDCacheKey is the key under which the user owning the normalized flexid
+// is cached.
+func flexIDCacheKey(fid string, fidT FlexIDType) string {
+	return fmt.Sprintf("flexid:%d:%s", fidT, fid)
+}
+
+// Invalidate evicts the user from the cache.
+func (c *UserCache) Invalidate(uid uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, el := range c.entries {
+		if el.Value.(*userCacheEntry).user.ID == uid {
+			c.remove(el)
+		}
+	}
+}
+
+// get returns a copy of the unexpired user cached under key, if any.
+func (c *UserCache) get(key string) (*User, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*userCacheEntry)
+	if !time.Now().Before(e.expiresAt) {
+		c.remove(el)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	u := e.user
+	return &u, true
+}
+
+// set caches a copy of u under key, evicting the least recently used entry if
+// the cache is full.
+func (c *UserCache) set(key string, u *User) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := &userCacheEntry{
+		key:       key,
+		user:      *u,
+		expiresAt: time.Now().Add(c.ttl),
+	}
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	if c.lru.Len() > c.max {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove deletes the entry. c.mu must be held.
+func (c *UserCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*userCacheEntry).key)
+}
+
+// invalidateCachedUser evicts the user from every UserCache.
+func invalidateCachedUser(uid uint64) {
+	userCaches.Lock()
+	defer userCaches.Unlock()
+	for _, c := range userCaches.caches {
+		c.Invalidate(uid)
+	}
+}
+
+// invalidateCachedFlexID evicts the user cached for the normalized flexid from
+// every UserCache, since the flexid may now resolve to someone else.
+func invalidateCachedFlexID(fid string, fidT FlexIDType) {
+	key := flexIDCacheKey(fid, fidT)
+	userCaches.Lock()
+	defer userCaches.Unlock()
+	for _, c := range userCaches.caches {
+		c.mu.Lock()
+		if el, ok := c.entries[key]; ok {
+			c.remove(el)
+		}
+		c.mu.Unlock()
+	}
+}
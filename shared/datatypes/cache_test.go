@@ -0,0 +1,218 @@
+package dt
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// countingQueryer counts the Get calls made through it.
+type countingQueryer struct {
+	*fakeQueryer
+	gets int
+}
+
+func (c *countingQueryer) Get(dest interface{}, query string,
+	args ...interface{}) error {
+
+	c.gets++
+	return c.fakeQueryer.Get(dest, query, args...)
+}
+
+func TestGetUserCached(t *testing.T) {
+	db := &countingQueryer{fakeQueryer: &fakeQueryer{
+		users: map[uint64]User{
+			1: {ID: 1, Name: "Alice", Email: "alice@example.com"},
+		},
+		flexIDs: map[string]uint64{"+13105555555": 1},
+	}}
+	c := NewUserCache(time.Hour)
+
+	// Miss
+	u, err := GetUserCached(c, db, &Request{UserID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "Alice" || db.gets != 1 {
+		t.Fatal("expected Alice from 1 query, got", u.Name, db.gets)
+	}
+
+	// Hit
+	u.Name = "changed by caller"
+	u, err = GetUserCached(c, db, &Request{UserID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "Alice" || db.gets != 1 {
+		t.Fatal("expected cached Alice, got", u.Name, db.gets)
+	}
+	req := &Request{FlexID: "+13105555555", FlexIDType: FIDTPhone}
+	for i := 0; i < 2; i++ {
+		if u, err = GetUserCached(c, db, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if u.ID != 1 || req.UserID != 1 || db.gets != 3 {
+		t.Fatal("expected flexid lookup to be cached, got", u.ID,
+			req.UserID, db.gets)
+	}
+
+	// Unregistered users aren't cached.
+	for i := 0; i < 2; i++ {
+		req = &Request{FlexID: "+13105555556", FlexIDType: FIDTPhone}
+		if _, err = GetUserCached(c, db, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db.gets != 5 {
+		t.Fatal("expected unregistered user to be queried twice, got",
+			db.gets-3)
+	}
+
+	c.Invalidate(1)
+	if _, err = GetUserCached(c, db, &Request{UserID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if db.gets != 6 {
+		t.Fatal("expected query after Invalidate")
+	}
+}
+
+func TestGetUserCachedNormalizesFlexID(t *testing.T) {
+	db := &countingQueryer{fakeQueryer: &fakeQueryer{
+		users:   map[uint64]User{1: {ID: 1, Name: "Alice"}},
+		flexIDs: map[string]uint64{"+15551234567": 1},
+	}}
+	c := NewUserCache(time.Hour)
+	for _, fid := range []string{"+1 (555) 123-4567", "+15551234567",
+		"555.123.4567"} {
+		req := &Request{FlexID: fid}
+		u, err := GetUserCached(c, db, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.ID != 1 || req.UserID != 1 ||
+			req.FlexID != "+15551234567" || req.FlexIDType != FIDTPhone {
+			t.Fatalf("%s: expected normalized request for user 1, "+
+				"got %d %+v", fid, u.ID, *req)
+		}
+	}
+	if db.gets != 2 {
+		t.Fatal("expected formats to share a cache entry, got", db.gets)
+	}
+	_, err := GetUserCached(c, db, &Request{FlexID: "garbage"})
+	if err != ErrInvalidFlexIDType {
+		t.Fatal("expected ErrInvalidFlexIDType, got", err)
+	}
+}
+
+func TestUserCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewUserCache(time.Hour)
+	c.max = 2
+	for id := uint64(1); id <= 2; id++ {
+		c.set(fmt.Sprintf("id:%d", id), &User{ID: id})
+	}
+	// Using 1 makes 2 the least recently used.
+	if _, ok := c.get("id:1"); !ok {
+		t.Fatal("expected user 1 to be cached")
+	}
+	c.set("id:3", &User{ID: 3})
+	if _, ok := c.get("id:2"); ok {
+		t.Fatal("expected user 2 to be evicted")
+	}
+	for _, key := range []string{"id:1", "id:3"} {
+		if _, ok := c.get(key); !ok {
+			t.Fatal("expected to be cached:", key)
+		}
+	}
+	if len(c.entries) != 2 || c.lru.Len() != 2 {
+		t.Fatal("expected 2 entries, got", len(c.entries), c.lru.Len())
+	}
+}
+
+func TestGetUserCachedExpiry(t *testing.T) {
+	db := &countingQueryer{fakeQueryer: &fakeQueryer{
+		users: map[uint64]User{1: {ID: 1, Name: "Alice"}},
+	}}
+	c := NewUserCache(10 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		_, err := GetUserCached(c, db, &Request{UserID: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, err := GetUserCached(c, db, &Request{UserID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if db.gets != 2 {
+		t.Fatal("expected expired user to be queried again, got", db.gets)
+	}
+}
+
+func TestGetUserCachedInvalidatedByUpdate(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	c := NewUserCache(time.Hour)
+	if _, err := GetUserCached(c, testDB, &Request{UserID: u.ID}); err != nil {
+		t.Fatal(err)
+	}
+	u.Name = "Alice"
+	if err := u.Update(testDB); err != nil {
+		t.Fatal(err)
+	}
+	got, err := GetUserCached(c, testDB, &Request{UserID: u.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "Alice" {
+		t.Fatal("expected updated name Alice, got", got.Name)
+	}
+	if err = u.SetTrainer(testDB, true); err != nil {
+		t.Fatal(err)
+	}
+	got, err = GetUserCached(c, testDB, &Request{UserID: u.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Trainer {
+		t.Fatal("expected trainer after SetTrainer")
+	}
+
+	// A flexid cached for one user is evicted when another verifies it.
+	const phone = "+13105555555"
+	other := seedUser(t, "u@example.com")
+	if err = other.AddFlexID(testDB, phone, FIDTPhone); err != nil {
+		t.Fatal(err)
+	}
+	req := &Request{FlexID: phone, FlexIDType: FIDTPhone}
+	if got, err = GetUserCached(c, testDB, req); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != other.ID {
+		t.Fatal("expected phone to resolve to", other.ID, "got", got.ID)
+	}
+	code, err := u.StartPhoneVerification(testDB, phone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = u.ConfirmPhoneVerification(testDB, phone, code); err != nil {
+		t.Fatal(err)
+	}
+	req = &Request{FlexID: phone, FlexIDType: FIDTPhone}
+	if got, err = GetUserCached(c, testDB, req); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != u.ID {
+		t.Fatal("expected verified phone to resolve to", u.ID, "got",
+			got.ID)
+	}
+
+	if err = u.Delete(testDB); err != nil {
+		t.Fatal(err)
+	}
+	_, err = GetUserCached(c, testDB, &Request{UserID: u.ID})
+	if err != ErrMissingUser {
+		t.Fatal("expected ErrMissingUser after Delete, got", err)
+	}
+}
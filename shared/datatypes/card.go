@@ -1,6 +1,18 @@
 package dt
 
-import "database/sql"
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/bcrypt"
+)
 
 // Card represents a credit card. Note that information such as the card number,
 // security code and zip code are not present in this struct, since that data
@@ -30,3 +42,506 @@ type CardParams struct {
 	ExpYear        int
 	AddressZip     string
 }
+
+// String returns a masked description of the card suitable for logs and for
+// presenting to the user, e.g. "Visa ****4242 (exp 08/26)". The service token
+// and zip hash are never included.
+func (c Card) String() string {
+	return fmt.Sprintf("%s ****%s (exp %02d/%02d)", c.Brand, c.Last4,
+		c.ExpMonth, c.ExpYear%100)
+}
+
+// MarshalJSON encodes the card without its service token or zip hash, so cards
+// can be included in API responses without leaking sensitive fields.
+func (c Card) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ID             int
+		AddressID      sql.NullInt64
+		Last4          string
+		CardholderName string
+		ExpMonth       int
+		ExpYear        int
+		Brand          string
+	}{
+		ID:             c.ID,
+		AddressID:      c.AddressID,
+		Last4:          c.Last4,
+		CardholderName: c.CardholderName,
+		ExpMonth:       c.ExpMonth,
+		ExpYear:        c.ExpYear,
+		Brand:          c.Brand,
+	})
+}
+
+// IsExpired reports whether the card has expired at the given time. Cards are
+// valid through the last day of their expiration month.
+func (c *Card) IsExpired(at time.Time) bool {
+	year := c.ExpYear
+	if year < 100 {
+		// Two-digit years, e.g. 08/26
+		year += 2000
+	}
+	expires := time.Date(year, time.Month(c.ExpMonth)+1, 1, 0, 0, 0, 0,
+		at.Location())
+	return !at.Before(expires)
+}
+
+// Expired reports whether the card has already expired.
+func (c *Card) Expired() bool {
+	return c.IsExpired(time.Now())
+}
+
+// ExpiresSoon reports whether a card which hasn't yet expired will do so within
+// the given duration, which is useful to prompt users to update their card.
+func (c *Card) ExpiresSoon(within time.Duration) bool {
+	now := time.Now()
+	return !c.IsExpired(now) && c.IsExpired(now.Add(within))
+}
+
+// acceptedCardBrands holds the lowercased brands accepted by this deployment.
+// When empty, every brand is accepted.
+var acceptedCardBrands map[string]bool
+
+// SetAcceptedCardBrands restricts the card brands accepted by this deployment,
+// e.g. []string{"Visa", "MasterCard"} for a merchant who doesn't accept Amex.
+// Brands are compared case-insensitively. Passing an empty list accepts every
+// brand, which is the default. It should be called during initialization,
+// before cards are checked.
+func SetAcceptedCardBrands(brands []string) {
+	acceptedCardBrands = map[string]bool{}
+	for _, b := range brands {
+		acceptedCardBrands[strings.ToLower(strings.TrimSpace(b))] = true
+	}
+}
+
+// Accepted reports whether the card's brand is accepted by this deployment.
+// See SetAcceptedCardBrands.
+func (c *Card) Accepted() bool {
+	if len(acceptedCardBrands) == 0 {
+		return true
+	}
+	return acceptedCardBrands[strings.ToLower(strings.TrimSpace(c.Brand))]
+}
+
+// cardBrandRanges maps ranges of card number prefixes (IINs) to the brand
+// names used by the payment service. A number is in a range if its leading
+// digits fall between lo and hi inclusive. More specific ranges come first.
+var cardBrandRanges = []struct {
+	lo, hi int
+	digits int
+	brand  string
+}{
+	{4, 4, 1, "Visa"},
+	{51, 55, 2, "MasterCard"},
+	{2221, 2720, 4, "MasterCard"},
+	{34, 34, 2, "American Express"},
+	{37, 37, 2, "American Express"},
+	{6011, 6011, 4, "Discover"},
+	{622126, 622925, 6, "Discover"},
+	{644, 649, 3, "Discover"},
+	{65, 65, 2, "Discover"},
+	{3528, 3589, 4, "JCB"},
+	{300, 305, 3, "Diners Club"},
+	{3095, 3095, 4, "Diners Club"},
+	{36, 36, 2, "Diners Club"},
+	{38, 39, 2, "Diners Club"},
+}
+
+// DetectBrand returns the brand of a full or partial card number from its
+// leading digits, e.g. "Visa" for numbers beginning with 4, matching the brand
+// names reported by the payment service. Spaces and dashes are ignored. An
+// empty string is returned if the brand is unknown.
+func DetectBrand(number string) string {
+	number = regexCardNumberFormatting.ReplaceAllString(number, "")
+	if !regexDigits.MatchString(number) {
+		return ""
+	}
+	for _, r := range cardBrandRanges {
+		if len(number) < r.digits {
+			continue
+		}
+		n, err := strconv.Atoi(number[:r.digits])
+		if err != nil {
+			return ""
+		}
+		if n >= r.lo && n <= r.hi {
+			return r.brand
+		}
+	}
+	return ""
+}
+
+// ErrInvalidZip is returned when a zip code doesn't begin with five digits.
+var ErrInvalidZip = errors.New("invalid zip")
+
+// regexZip5 matches the five-digit prefix of a U.S. zip or zip+4 code.
+var regexZip5 = regexp.MustCompile(`^\s*([0-9]{5})(-?[0-9]{4})?\s*$`)
+
+// HashZip5 hashes the five-digit prefix of a zip code for storage in a card's
+// Zip5Hash. Like passwords, zips are hashed with bcrypt, which salts each hash,
+// so the same zip hashes differently every time. Use VerifyZip to compare.
+func HashZip5(zip string) ([]byte, error) {
+	m := regexZip5.FindStringSubmatch(zip)
+	if m == nil {
+		return nil, ErrInvalidZip
+	}
+	return bcrypt.GenerateFromPassword([]byte(m[1]), 10)
+}
+
+// VerifyZip reports whether the zip code matches the card's billing zip, e.g.
+// to confirm a zip spoken by the user before charging the card.
+func (c *Card) VerifyZip(zip string) bool {
+	m := regexZip5.FindStringSubmatch(zip)
+	if m == nil || len(c.Zip5Hash) == 0 {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(c.Zip5Hash, []byte(m[1])) == nil
+}
+
+// ErrInvalidCardNumber is returned when a card number has the wrong length or
+// fails the Luhn checksum.
+var ErrInvalidCardNumber = errors.New("invalid card number")
+
+// ErrCardNumberMismatch is returned when a valid card number doesn't end in the
+// card's Last4.
+var ErrCardNumberMismatch = errors.New("card number doesn't match card")
+
+// regexCardNumberFormatting matches the spaces and dashes commonly used to
+// group the digits of a card number.
+var regexCardNumberFormatting = regexp.MustCompile(`[\s\-]`)
+
+// ValidLuhn reports whether number is a plausible card number, i.e. it has
+// between 12 and 19 digits and passes the Luhn checksum. Spaces and dashes are
+// ignored.
+func ValidLuhn(number string) bool {
+	number = regexCardNumberFormatting.ReplaceAllString(number, "")
+	if len(number) < 12 || len(number) > 19 ||
+		!regexDigits.MatchString(number) {
+		return false
+	}
+	sum := 0
+	for i := 0; i < len(number); i++ {
+		d := int(number[len(number)-1-i] - '0')
+		if i%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// ValidateNumber checks a full card number, e.g. one dictated by the user for
+// manual entry, before it's sent to the payment service. ErrInvalidCardNumber
+// is returned if it fails ValidLuhn, and ErrCardNumberMismatch if it doesn't
+// end in the card's Last4.
+func (c *Card) ValidateNumber(full string) error {
+	if !ValidLuhn(full) {
+		return ErrInvalidCardNumber
+	}
+	full = regexCardNumberFormatting.ReplaceAllString(full, "")
+	if !strings.HasSuffix(full, c.Last4) || len(c.Last4) != 4 {
+		return ErrCardNumberMismatch
+	}
+	return nil
+}
+
+// ErrCardNotFound is returned when a card is expected but none found, including
+// when the card belongs to another user.
+var ErrCardNotFound = errors.New("card not found")
+
+// cardColumns are selected when loading a card.
+const cardColumns = `id, addressid, last4, cardholdername, expmonth, expyear,
+	brand, servicetoken, zip5hash`
+
+// GetCards returns all of the user's cards, oldest first.
+func (u *User) GetCards(db Queryer) (_ []Card, err error) {
+	defer observe("User.GetCards", time.Now(), &err)
+	cards := []Card{}
+	q := `SELECT ` + cardColumns + ` FROM cards WHERE userid=$1 ORDER BY id`
+	if err := db.Select(&cards, q, u.ID); err != nil {
+		return nil, err
+	}
+	return cards, nil
+}
+
+// GetUserWithPayment loads a user together with all of their cards, oldest
+// first, in a single query. A user without cards is returned with an empty
+// slice. ErrMissingUser is returned if the user doesn't exist.
+func GetUserWithPayment(db Queryer, uid uint64) (_ *User, _ []Card,
+	err error) {
+
+	defer observe("GetUserWithPayment", time.Now(), &err)
+	var rows []struct {
+		User
+		CardID             sql.NullInt64
+		CardAddressID      sql.NullInt64
+		CardLast4          sql.NullString
+		CardCardholderName sql.NullString
+		CardExpMonth       sql.NullInt64
+		CardExpYear        sql.NullInt64
+		CardBrand          sql.NullString
+		CardServiceToken   sql.NullString
+		CardZip5Hash       []byte
+	}
+	q := `SELECT u.id, u.name, u.email, u.admin, u.trainer,
+		u.paymentserviceid, u.disabled, u.contactpreference,
+		c.id AS cardid, c.addressid AS cardaddressid,
+		c.last4 AS cardlast4, c.cardholdername AS cardcardholdername,
+		c.expmonth AS cardexpmonth, c.expyear AS cardexpyear,
+		c.brand AS cardbrand, c.servicetoken AS cardservicetoken,
+		c.zip5hash AS cardzip5hash
+	      FROM users u
+	      LEFT JOIN cards c ON c.userid=u.id
+	      WHERE u.id=$1
+	      ORDER BY c.id`
+	if err = db.Select(&rows, q, uid); err != nil {
+		return nil, nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil, ErrMissingUser
+	}
+	u := rows[0].User
+	cards := []Card{}
+	for _, r := range rows {
+		if !r.CardID.Valid {
+			continue
+		}
+		cards = append(cards, Card{
+			ID:             int(r.CardID.Int64),
+			AddressID:      r.CardAddressID,
+			Last4:          r.CardLast4.String,
+			CardholderName: r.CardCardholderName.String,
+			ExpMonth:       int(r.CardExpMonth.Int64),
+			ExpYear:        int(r.CardExpYear.Int64),
+			Brand:          r.CardBrand.String,
+			ServiceToken:   r.CardServiceToken.String,
+			Zip5Hash:       r.CardZip5Hash,
+		})
+	}
+	return &u, cards, nil
+}
+
+// MaxPageSize is the largest number of results returned by a single page of a
+// paginated query. Larger limits are reduced to MaxPageSize.
+const MaxPageSize = 100
+
+// ErrInvalidPage is returned when a paginated query has a limit less than one
+// or a negative offset.
+var ErrInvalidPage = errors.New("invalid page")
+
+// GetCardsPaged returns up to limit of the user's cards, oldest first,
+// skipping the first offset cards. The total number of cards the user has is
+// returned alongside so callers can show how many pages there are.
+func (u *User) GetCardsPaged(db Queryer, limit, offset int) (_ []Card, _ int,
+	err error) {
+
+	defer observe("User.GetCardsPaged", time.Now(), &err)
+	if limit < 1 || offset < 0 {
+		return nil, 0, ErrInvalidPage
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+	var total int
+	q := `SELECT COUNT(*) FROM cards WHERE userid=$1`
+	if err := db.Get(&total, q, u.ID); err != nil {
+		return nil, 0, err
+	}
+	cards := []Card{}
+	q = `SELECT ` + cardColumns + ` FROM cards WHERE userid=$1
+	     ORDER BY id LIMIT $2 OFFSET $3`
+	if err := db.Select(&cards, q, u.ID, limit, offset); err != nil {
+		return nil, 0, err
+	}
+	return cards, total, nil
+}
+
+// HasPaymentMethod reports whether the user has at least one card which hasn't
+// expired. A user without any cards has no payment method, which isn't an
+// error.
+func (u *User) HasPaymentMethod(db Queryer) (_ bool, err error) {
+	defer observe("User.HasPaymentMethod", time.Now(), &err)
+	cards, err := u.GetCards(db)
+	if err != nil {
+		return false, err
+	}
+	for i := range cards {
+		if !cards[i].Expired() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// GetCardByID returns one of the user's cards. ErrCardNotFound is returned if
+// the card doesn't exist or belongs to another user.
+func (u *User) GetCardByID(db Queryer, id uint64) (_ *Card, err error) {
+	defer observe("User.GetCardByID", time.Now(), &err)
+	c := &Card{}
+	q := `SELECT ` + cardColumns + ` FROM cards WHERE id=$1 AND userid=$2`
+	err = db.Get(c, q, id, u.ID)
+	if err == sql.ErrNoRows {
+		return nil, ErrCardNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ErrAmbiguousCard is returned when more than one of the user's cards matches
+// a description, e.g. when a user with two Visas asks to use "my Visa".
+var ErrAmbiguousCard = errors.New("ambiguous card")
+
+// FindCard returns the user's only card matching the brand and last4, either
+// of which may be empty to match any card. Brands are compared
+// case-insensitively. ErrCardNotFound is returned if no card matches, and
+// ErrAmbiguousCard if more than one does.
+func (u *User) FindCard(db Queryer, brand, last4 string) (_ *Card, err error) {
+	defer observe("User.FindCard", time.Now(), &err)
+	brand = strings.TrimSpace(brand)
+	last4 = strings.TrimSpace(last4)
+	var cards []Card
+	q := `SELECT ` + cardColumns + ` FROM cards
+	      WHERE userid=$1
+		AND ($2='' OR LOWER(brand)=LOWER($2))
+		AND ($3='' OR last4=$3)
+	      ORDER BY id
+	      LIMIT 2`
+	if err = db.Select(&cards, q, u.ID, brand, last4); err != nil {
+		return nil, err
+	}
+	switch len(cards) {
+	case 0:
+		return nil, ErrCardNotFound
+	case 1:
+		return &cards[0], nil
+	}
+	return nil, ErrAmbiguousCard
+}
+
+// AddCard saves a card for the user, returning the ID of the newly created
+// card. The card's ServiceToken must already have been issued by the payment
+// service. Payment drivers may use this from their SaveCard implementations.
+// The addition is recorded in the user's AuditLog in the same transaction.
+func (u *User) AddCard(db Queryer, c *Card) (_ uint64, err error) {
+	defer observe("User.AddCard", time.Now(), &err)
+	var id uint64
+	err = inTx(db, func(tx Queryer) error {
+		q := `INSERT INTO cards (userid, addressid, last4, cardholdername,
+			expmonth, expyear, brand, servicetoken, zip5hash)
+		      VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		      RETURNING id`
+		err := tx.QueryRowx(q, u.ID, c.AddressID, c.Last4,
+			c.CardholderName, c.ExpMonth, c.ExpYear, c.Brand,
+			c.ServiceToken, c.Zip5Hash).Scan(&id)
+		if err != nil {
+			return err
+		}
+		return audit(tx, u.ID, AuditCardAdded, id)
+	})
+	if err != nil {
+		return 0, err
+	}
+	c.ID = int(id)
+	return id, nil
+}
+
+// IdempotencyTTL is how long an idempotency key passed to AddCardIdempotent is
+// remembered.
+const IdempotencyTTL = 24 * time.Hour
+
+// AddCardIdempotent is the same as AddCard, except that replaying the same key
+// within IdempotencyTTL returns the card created by the first call rather than
+// inserting a duplicate. This makes saving a card safe to retry after a
+// network error. If two calls with the same key race, one of them fails and
+// may be retried.
+func (u *User) AddCardIdempotent(db *sqlx.DB, c *Card, key string) (
+	_ uint64, err error) {
+
+	defer observe("User.AddCardIdempotent", time.Now(), &err)
+	var id uint64
+	err = WithTx(db, func(tx *sqlx.Tx) error {
+		q := `SELECT resourceid FROM idempotencykeys
+		      WHERE userid=$1 AND idempotencykey=$2
+			AND expiresat > CURRENT_TIMESTAMP`
+		err := tx.Get(&id, q, u.ID, key)
+		if err == nil {
+			c.ID = int(id)
+			return nil
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+		q = `DELETE FROM idempotencykeys
+		     WHERE userid=$1 AND idempotencykey=$2`
+		if _, err = tx.Exec(q, u.ID, key); err != nil {
+			return err
+		}
+		if id, err = u.AddCard(tx, c); err != nil {
+			return err
+		}
+		q = `INSERT INTO idempotencykeys
+			(userid, idempotencykey, resourceid, expiresat)
+		     VALUES ($1, $2, $3, CURRENT_TIMESTAMP + $4::INTERVAL)`
+		_, err = tx.Exec(q, u.ID, key, id, pgInterval(IdempotencyTTL))
+		return err
+	})
+	if err != nil {
+		c.ID = 0
+		return 0, err
+	}
+	return id, nil
+}
+
+// DeleteCard removes one of the user's cards, recording the deletion in the
+// user's AuditLog in the same transaction. ErrCardNotFound is returned if the
+// card doesn't exist or belongs to another user.
+func (u *User) DeleteCard(db Queryer, cardID uint64) (err error) {
+	defer observe("User.DeleteCard", time.Now(), &err)
+	return inTx(db, func(tx Queryer) error {
+		q := `DELETE FROM cards WHERE id=$1 AND userid=$2`
+		res, err := tx.Exec(q, cardID, u.ID)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrCardNotFound
+		}
+		return audit(tx, u.ID, AuditCardDeleted, cardID)
+	})
+}
+
+// ReplaceCard swaps one of the user's cards for a new one, e.g. when the old
+// card is about to expire. The new card keeps the old card's address, and the
+// old card is deleted in the same transaction. ErrCardNotFound is returned if
+// the old card doesn't exist or belongs to another user.
+func (u *User) ReplaceCard(db *sqlx.DB, oldID uint64, newCard *Card) (
+	_ uint64, err error) {
+
+	defer observe("User.ReplaceCard", time.Now(), &err)
+	var id uint64
+	err = WithTx(db, func(tx *sqlx.Tx) error {
+		old, err := u.GetCardByID(tx, oldID)
+		if err != nil {
+			return err
+		}
+		newCard.AddressID = old.AddressID
+		if id, err = u.AddCard(tx, newCard); err != nil {
+			return err
+		}
+		return u.DeleteCard(tx, oldID)
+	})
+	if err != nil {
+		newCard.ID = 0
+		return 0, err
+	}
+	return id, nil
+}
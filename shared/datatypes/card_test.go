@@ -0,0 +1,610 @@
+package dt
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCardString(t *testing.T) {
+	c := &Card{
+		Last4:        "4242",
+		ExpMonth:     8,
+		ExpYear:      2026,
+		Brand:        "Visa",
+		ServiceToken: "tok_secret",
+		Zip5Hash:     []byte("zip_secret"),
+	}
+	expected := "Visa ****4242 (exp 08/26)"
+	if c.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, c.String())
+	}
+	if s := fmt.Sprint(*c); s != expected {
+		t.Fatalf("expected %q formatting a value, got %q", expected, s)
+	}
+}
+
+func TestCardMarshalJSON(t *testing.T) {
+	c := Card{
+		ID:             1,
+		Last4:          "4242",
+		CardholderName: "t",
+		ExpMonth:       8,
+		ExpYear:        2026,
+		Brand:          "Visa",
+		ServiceToken:   "tok_secret",
+		Zip5Hash:       []byte("zip_secret"),
+	}
+	for _, v := range []interface{}{c, &c, []Card{c}} {
+		byt, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := string(byt)
+		if strings.Contains(s, "tok_secret") ||
+			strings.Contains(s, "ServiceToken") ||
+			strings.Contains(s, "Zip5Hash") {
+			t.Fatal("expected secrets to be omitted, got", s)
+		}
+		if !strings.Contains(s, `"Last4":"4242"`) {
+			t.Fatal("expected Last4 in output, got", s)
+		}
+	}
+}
+
+func TestCardIsExpired(t *testing.T) {
+	c := &Card{ExpMonth: 8, ExpYear: 2026}
+	tests := map[time.Time]bool{
+		time.Date(2026, 7, 15, 0, 0, 0, 0, time.UTC):            false,
+		time.Date(2026, 8, 1, 0, 0, 0, 0, time.UTC):             false,
+		time.Date(2026, 8, 31, 23, 59, 59, 999999999, time.UTC): false,
+		time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC):             true,
+		time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC):             true,
+		time.Date(2025, 12, 31, 0, 0, 0, 0, time.UTC):           false,
+	}
+	for at, expected := range tests {
+		if c.IsExpired(at) != expected {
+			t.Fatalf("%s: expected expired=%t", at, expected)
+		}
+	}
+
+	// Cards expiring in December are valid through the end of the year.
+	c = &Card{ExpMonth: 12, ExpYear: 26}
+	tests = map[time.Time]bool{
+		time.Date(2026, 12, 31, 23, 59, 59, 0, time.UTC): false,
+		time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC):      true,
+	}
+	for at, expected := range tests {
+		if c.IsExpired(at) != expected {
+			t.Fatalf("%s: expected expired=%t", at, expected)
+		}
+	}
+}
+
+func TestCardExpiresSoon(t *testing.T) {
+	now := time.Now()
+	c := &Card{ExpMonth: int(now.Month()), ExpYear: now.Year()}
+	if c.Expired() {
+		t.Fatal("expected card expiring this month to be valid")
+	}
+	if !c.ExpiresSoon(32 * 24 * time.Hour) {
+		t.Fatal("expected card expiring this month to expire soon")
+	}
+	next := now.AddDate(2, 0, 0)
+	c = &Card{ExpMonth: int(next.Month()), ExpYear: next.Year()}
+	if c.ExpiresSoon(30 * 24 * time.Hour) {
+		t.Fatal("expected card expiring in two years not to expire soon")
+	}
+	c = &Card{ExpMonth: 1, ExpYear: 2000}
+	if !c.Expired() || c.ExpiresSoon(time.Hour) {
+		t.Fatal("expected expired card to be expired, not expiring soon")
+	}
+}
+
+func TestCardAccepted(t *testing.T) {
+	visa := &Card{Brand: "Visa"}
+	amex := &Card{Brand: "American Express"}
+	if !visa.Accepted() || !amex.Accepted() {
+		t.Fatal("expected all brands to be accepted by default")
+	}
+	SetAcceptedCardBrands([]string{"VISA", " MasterCard "})
+	defer SetAcceptedCardBrands(nil)
+	if !visa.Accepted() {
+		t.Fatal("expected Visa to be accepted")
+	}
+	if !(&Card{Brand: "mastercard"}).Accepted() {
+		t.Fatal("expected MasterCard to be accepted")
+	}
+	if amex.Accepted() {
+		t.Fatal("expected American Express to be rejected")
+	}
+	SetAcceptedCardBrands(nil)
+	if !amex.Accepted() {
+		t.Fatal("expected all brands to be accepted after clearing")
+	}
+}
+
+func TestVerifyZip(t *testing.T) {
+	for _, zip := range []string{"02134", "90210"} {
+		hash, err := HashZip5(zip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &Card{Zip5Hash: hash}
+		if !c.VerifyZip(zip) {
+			t.Fatal("expected zip to match", zip)
+		}
+		if !c.VerifyZip(" " + zip + "-1234") {
+			t.Fatal("expected zip+4 to match", zip)
+		}
+	}
+	hash, err := HashZip5("02134-1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Card{Zip5Hash: hash}
+	for _, zip := range []string{"2134", "20134", "02135", "", "abcde"} {
+		if c.VerifyZip(zip) {
+			t.Fatal("expected zip not to match", zip)
+		}
+	}
+	if (&Card{}).VerifyZip("02134") {
+		t.Fatal("expected card without a zip hash not to match")
+	}
+	if _, err = HashZip5("2134"); err != ErrInvalidZip {
+		t.Fatal("expected ErrInvalidZip, got", err)
+	}
+}
+
+func TestValidLuhn(t *testing.T) {
+	tests := map[string]bool{
+		"4242424242424242":    true,
+		"4242 4242 4242 4242": true,
+		"4242-4242-4242-4242": true,
+		"378282246310005":     true, // Amex
+		"6011111111111117":    true, // Discover
+		"4242424242424241":    false,
+		"4242 4242 4242 4243": false,
+		"4242424242a24242":    false,
+		"0000 0000 000":       false,
+		"":                    false,
+	}
+	for number, want := range tests {
+		if got := ValidLuhn(number); got != want {
+			t.Fatalf("%q: expected %t, got %t", number, want, got)
+		}
+	}
+}
+
+func TestDetectBrand(t *testing.T) {
+	tests := map[string]string{
+		"4242 4242 4242 4242": "Visa",
+		"4":                   "Visa",
+		"5105105105105100":    "MasterCard",
+		"5555-5555-5555-4444": "MasterCard",
+		"2221000000000009":    "MasterCard",
+		"2720990000000007":    "MasterCard",
+		"2220990000000000":    "",
+		"2721000000000000":    "",
+		"378282246310005":     "American Express",
+		"341111111111111":     "American Express",
+		"6011111111111117":    "Discover",
+		"6221260000000000":    "Discover",
+		"6229250000000000":    "Discover",
+		"6221250000000000":    "",
+		"6440000000000000":    "Discover",
+		"6500000000000000":    "Discover",
+		"3530111333300000":    "JCB",
+		"3590000000000000":    "",
+		"30569309025904":      "Diners Club",
+		"3095000000000000":    "Diners Club",
+		"36000000000000":      "Diners Club",
+		"1234567890123456":    "",
+		"4242a":               "",
+		"":                    "",
+	}
+	for number, want := range tests {
+		if got := DetectBrand(number); got != want {
+			t.Fatalf("%q: expected %q, got %q", number, want, got)
+		}
+	}
+}
+
+func TestCardValidateNumber(t *testing.T) {
+	c := &Card{Last4: "4242"}
+	tests := map[string]error{
+		"4242 4242 4242 4242": nil,
+		"4242424242424241":    ErrInvalidCardNumber,
+		"4000 0566 5566 5556": ErrCardNumberMismatch,
+	}
+	for number, want := range tests {
+		if err := c.ValidateNumber(number); err != want {
+			t.Fatalf("%q: expected %v, got %v", number, want, err)
+		}
+	}
+}
+
+func TestAddDeleteCard(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	other := seedUser(t, "u@example.com")
+	c := &Card{
+		Last4:          "4242",
+		CardholderName: "t",
+		ExpMonth:       8,
+		ExpYear:        2030,
+		Brand:          "Visa",
+		ServiceToken:   "tok_4242",
+	}
+	id, err := u.AddCard(testDB, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == 0 || uint64(c.ID) != id {
+		t.Fatal("expected card ID to be set, got", id, c.ID)
+	}
+	if err = other.DeleteCard(testDB, id); err != ErrCardNotFound {
+		t.Fatal("expected ErrCardNotFound deleting another user's card, got",
+			err)
+	}
+	if err = u.DeleteCard(testDB, id); err != nil {
+		t.Fatal(err)
+	}
+	if err = u.DeleteCard(testDB, id); err != ErrCardNotFound {
+		t.Fatal("expected ErrCardNotFound deleting a deleted card, got",
+			err)
+	}
+}
+
+func TestReplaceCard(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	other := seedUser(t, "u@example.com")
+	old := seedCard(t, u, "4242")
+	c := &Card{
+		Last4:          "1111",
+		CardholderName: u.Name,
+		ExpMonth:       8,
+		ExpYear:        2034,
+		Brand:          "Visa",
+		ServiceToken:   "tok_1111",
+	}
+	_, err := other.ReplaceCard(testDB, uint64(old.ID), c)
+	if err != ErrCardNotFound {
+		t.Fatal("expected ErrCardNotFound replacing another user's card, got",
+			err)
+	}
+	if c.ID != 0 {
+		t.Fatal("expected card ID to be unset after a failed replace")
+	}
+	id, err := u.ReplaceCard(testDB, uint64(old.ID), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cards, err := u.GetCards(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cards) != 1 || uint64(cards[0].ID) != id {
+		t.Fatal("expected only the new card to remain, got", cards)
+	}
+	if cards[0].AddressID != old.AddressID {
+		t.Fatal("expected address to carry over, got", cards[0].AddressID)
+	}
+}
+
+func TestAddCardIdempotent(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	newCard := func(last4 string) *Card {
+		return &Card{
+			Last4:          last4,
+			CardholderName: u.Name,
+			ExpMonth:       8,
+			ExpYear:        2030,
+			Brand:          "Visa",
+			ServiceToken:   "tok_" + last4,
+		}
+	}
+	id, err := u.AddCardIdempotent(testDB, newCard("4242"), "key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newCard("4242")
+	replayed, err := u.AddCardIdempotent(testDB, c, "key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed != id || uint64(c.ID) != id {
+		t.Fatal("expected replay to return card", id, "got", replayed)
+	}
+	if _, err = u.AddCardIdempotent(testDB, newCard("1111"), "key2"); err != nil {
+		t.Fatal(err)
+	}
+	cards, err := u.GetCards(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cards) != 2 {
+		t.Fatal("expected 2 cards, got", len(cards))
+	}
+
+	// Expired keys are forgotten.
+	q := `UPDATE idempotencykeys
+	      SET expiresat=CURRENT_TIMESTAMP - INTERVAL '1 minute'
+	      WHERE userid=$1 AND idempotencykey='key2'`
+	if _, err = testDB.Exec(q, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = u.AddCardIdempotent(testDB, newCard("0005"), "key2"); err != nil {
+		t.Fatal(err)
+	}
+	if cards, err = u.GetCards(testDB); err != nil {
+		t.Fatal(err)
+	}
+	if len(cards) != 3 {
+		t.Fatal("expected 3 cards after the key expired, got", len(cards))
+	}
+}
+
+func TestHasPaymentMethod(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	ok, err := u.HasPaymentMethod(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("expected no payment method without cards")
+	}
+	expired := seedCard(t, u, "4242")
+	q := `UPDATE cards SET expyear=2015 WHERE id=$1`
+	if _, err = testDB.Exec(q, expired.ID); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err = u.HasPaymentMethod(testDB); err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("expected no payment method with only an expired card")
+	}
+	seedCard(t, u, "1111")
+	if ok, err = u.HasPaymentMethod(testDB); err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected a payment method with a valid card")
+	}
+}
+
+// seedCard adds a Visa card to the user with the given last 4 digits.
+func seedCard(t testing.TB, u *User, last4 string) *Card {
+	c := &Card{
+		AddressID:      sql.NullInt64{Int64: 1, Valid: true},
+		Last4:          last4,
+		CardholderName: u.Name,
+		ExpMonth:       8,
+		ExpYear:        2030,
+		Brand:          "Visa",
+		ServiceToken:   fmt.Sprintf("tok_%d_%s", u.ID, last4),
+		Zip5Hash:       []byte("hash"),
+	}
+	if _, err := u.AddCard(testDB, c); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestGetCards(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	other := seedUser(t, "u@example.com")
+	cards, err := u.GetCards(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cards) != 0 {
+		t.Fatal("expected no cards, got", len(cards))
+	}
+	expected := []*Card{seedCard(t, u, "4242"), seedCard(t, u, "1111")}
+	seedCard(t, other, "0005")
+	cards, err = u.GetCards(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cards) != len(expected) {
+		t.Fatal("expected", len(expected), "cards, got", len(cards))
+	}
+	for i, c := range cards {
+		if !reflect.DeepEqual(c, *expected[i]) {
+			t.Fatalf("expected %+v, got %+v", *expected[i], c)
+		}
+	}
+}
+
+func TestGetUserWithPayment(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	got, cards, err := GetUserWithPayment(testDB, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != u.ID || got.Email != u.Email {
+		t.Fatal("expected user", u.ID, "got", got.ID)
+	}
+	if cards == nil || len(cards) != 0 {
+		t.Fatal("expected an empty slice of cards, got", cards)
+	}
+	expected := []*Card{seedCard(t, u, "4242"), seedCard(t, u, "1111")}
+	seedCard(t, seedUser(t, "u@example.com"), "0005")
+	if _, cards, err = GetUserWithPayment(testDB, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if len(cards) != len(expected) {
+		t.Fatal("expected", len(expected), "cards, got", len(cards))
+	}
+	for i, c := range cards {
+		if !reflect.DeepEqual(c, *expected[i]) {
+			t.Fatalf("expected %+v, got %+v", *expected[i], c)
+		}
+	}
+	if _, _, err = GetUserWithPayment(testDB, u.ID+100); err != ErrMissingUser {
+		t.Fatal("expected ErrMissingUser, got", err)
+	}
+}
+
+func seedUserWithCards(b *testing.B, n int) *User {
+	requireDB(b)
+	u := seedUser(b, "t@example.com")
+	for i := 0; i < n; i++ {
+		seedCard(b, u, fmt.Sprintf("%04d", i))
+	}
+	b.ResetTimer()
+	return u
+}
+
+func BenchmarkGetUserWithPayment(b *testing.B) {
+	u := seedUserWithCards(b, 5)
+	for n := 0; n < b.N; n++ {
+		if _, _, err := GetUserWithPayment(testDB, u.ID); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetUserWithPaymentSeparate(b *testing.B) {
+	u := seedUserWithCards(b, 5)
+	for n := 0; n < b.N; n++ {
+		got, err := GetUser(testDB, &Request{UserID: u.ID})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err = got.GetCards(testDB); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestGetCardsPaged(t *testing.T) {
+	u := &User{ID: 1}
+	for _, page := range [][2]int{{0, 0}, {-1, 0}, {1, -1}} {
+		_, _, err := u.GetCardsPaged(nil, page[0], page[1])
+		if err != ErrInvalidPage {
+			t.Fatalf("limit %d offset %d: expected ErrInvalidPage, got %v",
+				page[0], page[1], err)
+		}
+	}
+
+	requireDB(t)
+	u = seedUser(t, "t@example.com")
+	other := seedUser(t, "u@example.com")
+	var expected []*Card
+	for _, last4 := range []string{"0001", "0002", "0003", "0004", "0005"} {
+		expected = append(expected, seedCard(t, u, last4))
+	}
+	seedCard(t, other, "0006")
+	tests := []struct {
+		limit, offset int
+		want          []*Card
+	}{
+		{2, 0, expected[0:2]},
+		{2, 2, expected[2:4]},
+		{2, 4, expected[4:5]},
+		{2, 6, nil},
+		{MaxPageSize + 1, 0, expected},
+	}
+	for _, test := range tests {
+		cards, total, err := u.GetCardsPaged(testDB, test.limit,
+			test.offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != len(expected) {
+			t.Fatal("expected total", len(expected), "got", total)
+		}
+		if len(cards) != len(test.want) {
+			t.Fatalf("limit %d offset %d: expected %d cards, got %d",
+				test.limit, test.offset, len(test.want), len(cards))
+		}
+		for i, c := range cards {
+			if c.ID != test.want[i].ID {
+				t.Fatalf("limit %d offset %d: expected card %d, got %d",
+					test.limit, test.offset, test.want[i].ID, c.ID)
+			}
+		}
+	}
+}
+
+func TestFindCard(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	visa1 := seedCard(t, u, "4242")
+	visa2 := seedCard(t, u, "1881")
+	mc := &Card{
+		AddressID:      sql.NullInt64{Int64: 1, Valid: true},
+		Last4:          "4444",
+		CardholderName: u.Name,
+		ExpMonth:       8,
+		ExpYear:        2030,
+		Brand:          "MasterCard",
+		ServiceToken:   "tok_mc",
+	}
+	if _, err := u.AddCard(testDB, mc); err != nil {
+		t.Fatal(err)
+	}
+	other := seedUser(t, "u@example.com")
+	seedCard(t, other, "0005")
+
+	tests := []struct {
+		brand, last4 string
+		id           int
+		err          error
+	}{
+		{"mastercard", "", mc.ID, nil},
+		{"", "4242", visa1.ID, nil},
+		{"VISA", "1881", visa2.ID, nil},
+		{"visa", "", 0, ErrAmbiguousCard},
+		{"", "", 0, ErrAmbiguousCard},
+		{"Visa", "4444", 0, ErrCardNotFound},
+		{"Discover", "", 0, ErrCardNotFound},
+		{"", "0005", 0, ErrCardNotFound},
+	}
+	for _, test := range tests {
+		c, err := u.FindCard(testDB, test.brand, test.last4)
+		if err != test.err {
+			t.Fatalf("%q %q: expected %v, got %v", test.brand,
+				test.last4, test.err, err)
+		}
+		if err == nil && c.ID != test.id {
+			t.Fatalf("%q %q: expected card %d, got %d", test.brand,
+				test.last4, test.id, c.ID)
+		}
+	}
+}
+
+func TestGetCardByID(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	other := seedUser(t, "u@example.com")
+	expected := seedCard(t, u, "4242")
+	c, err := u.GetCardByID(testDB, uint64(expected.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, c)
+	}
+	_, err = other.GetCardByID(testDB, uint64(expected.ID))
+	if err != ErrCardNotFound {
+		t.Fatal("expected ErrCardNotFound for another user's card, got",
+			err)
+	}
+	_, err = u.GetCardByID(testDB, uint64(expected.ID+100))
+	if err != ErrCardNotFound {
+		t.Fatal("expected ErrCardNotFound for missing card, got", err)
+	}
+}
@@ -0,0 +1,128 @@
+package dt
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Contactable is anything with a name and email address that can be notified,
+// such as a User.
+type Contactable interface {
+	GetName() string
+	GetEmail() string
+}
+
+// GetName returns the user's name, satisfying Contactable.
+func (u *User) GetName() string {
+	return u.Name
+}
+
+// GetEmail returns the user's primary email, satisfying Contactable. See
+// Emails for the rest of their addresses.
+func (u *User) GetEmail() string {
+	return u.Email
+}
+
+// FormatRecipients formats each Contactable as an address suitable for an
+// email To header, e.g. "Alice <alice@example.com>". Names containing special
+// characters are quoted per RFC 5322, and contacts without an email are
+// skipped.
+func FormatRecipients(cs []Contactable) []string {
+	var tos []string
+	for _, c := range cs {
+		email := strings.TrimSpace(c.GetEmail())
+		if email == "" {
+			continue
+		}
+		name := strings.TrimSpace(c.GetName())
+		if name == "" {
+			tos = append(tos, email)
+			continue
+		}
+		tos = append(tos, quoteName(name)+" <"+email+">")
+	}
+	return tos
+}
+
+// rfc5322Specials are the characters which can't appear in an unquoted display
+// name.
+const rfc5322Specials = `()<>[]:;@\,."`
+
+// quoteName quotes a display name if it contains special characters, escaping
+// any quotes and backslashes within it.
+func quoteName(name string) string {
+	if !strings.ContainsAny(name, rfc5322Specials) {
+		return name
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	return `"` + r.Replace(name) + `"`
+}
+
+// ContactPreference is the channel through which a user prefers to be
+// notified.
+type ContactPreference int
+
+// ContactPreferences are the channels a user may choose. Users who haven't
+// chosen are contacted by email.
+const (
+	ContactEmail ContactPreference = iota + 1
+	ContactSMS
+	ContactNone
+)
+
+// ErrInvalidContactPreference is returned when setting a ContactPreference
+// which isn't one of the defined values.
+var ErrInvalidContactPreference = errors.New("invalid contact preference")
+
+// contactPreference returns the user's loaded ContactPreference, defaulting to
+// ContactEmail when unset.
+func (u *User) contactPreference() ContactPreference {
+	if u.ContactPreference == 0 {
+		return ContactEmail
+	}
+	return u.ContactPreference
+}
+
+// PreferredContact loads the channel through which the user prefers to be
+// notified, defaulting to ContactEmail if the user hasn't chosen one.
+func (u *User) PreferredContact(db Queryer) (_ ContactPreference, err error) {
+	defer observe("User.PreferredContact", time.Now(), &err)
+	q := `SELECT contactpreference FROM users WHERE id=$1`
+	err = db.Get(&u.ContactPreference, q, u.ID)
+	if err == sql.ErrNoRows {
+		return 0, ErrMissingUser
+	}
+	if err != nil {
+		return 0, err
+	}
+	return u.contactPreference(), nil
+}
+
+// SetContactPreference saves the channel through which the user prefers to be
+// notified.
+func (u *User) SetContactPreference(db Queryer, p ContactPreference) (
+	err error) {
+
+	defer observe("User.SetContactPreference", time.Now(), &err)
+	if p < ContactEmail || p > ContactNone {
+		return ErrInvalidContactPreference
+	}
+	q := `UPDATE users SET contactpreference=$1, updatedat=CURRENT_TIMESTAMP
+	      WHERE id=$2`
+	res, err := db.Exec(q, p, u.ID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrMissingUser
+	}
+	u.ContactPreference = p
+	invalidateCachedUser(u.ID)
+	return nil
+}
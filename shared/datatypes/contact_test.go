@@ -0,0 +1,83 @@
+package dt
+
+import "testing"
+
+func TestContactPreference(t *testing.T) {
+	u := &User{ID: 1}
+	for _, p := range []ContactPreference{0, ContactNone + 1} {
+		err := u.SetContactPreference(nil, p)
+		if err != ErrInvalidContactPreference {
+			t.Fatal("expected ErrInvalidContactPreference, got", err)
+		}
+	}
+
+	requireDB(t)
+	u = seedUser(t, "t@example.com")
+	p, err := u.PreferredContact(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != ContactEmail {
+		t.Fatal("expected ContactEmail by default, got", p)
+	}
+	for _, exp := range []ContactPreference{ContactSMS, ContactNone,
+		ContactEmail} {
+		if err = u.SetContactPreference(testDB, exp); err != nil {
+			t.Fatal(err)
+		}
+		byEmail, err := GetUserByEmail(testDB, u.Email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		byID, err := GetUser(testDB, &Request{UserID: u.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, got := range []*User{byEmail, byID} {
+			if got.ContactPreference != exp {
+				t.Fatal("expected loaded", exp, "got",
+					got.ContactPreference)
+			}
+			if p, err = got.PreferredContact(testDB); err != nil {
+				t.Fatal(err)
+			}
+			if p != exp {
+				t.Fatal("expected", exp, "got", p)
+			}
+		}
+	}
+	missing := &User{ID: u.ID + 100}
+	if _, err = missing.PreferredContact(testDB); err != ErrMissingUser {
+		t.Fatal("expected ErrMissingUser, got", err)
+	}
+}
+
+func TestFormatRecipients(t *testing.T) {
+	cs := []Contactable{
+		&User{Name: "Alice", Email: "alice@example.com"},
+		&User{Name: "Smith, Bob", Email: "bob@example.com"},
+		&User{Name: `Carol "CJ" Jones`, Email: "carol@example.com"},
+		&User{Name: `D\E`, Email: "de@example.com"},
+		&User{Name: "No Email"},
+		&User{Email: "anon@example.com"},
+	}
+	expected := []string{
+		"Alice <alice@example.com>",
+		`"Smith, Bob" <bob@example.com>`,
+		`"Carol \"CJ\" Jones" <carol@example.com>`,
+		`"D\\E" <de@example.com>`,
+		"anon@example.com",
+	}
+	got := FormatRecipients(cs)
+	if len(got) != len(expected) {
+		t.Fatalf("expected %q, got %q", expected, got)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Fatalf("expected %s, got %s", expected[i], got[i])
+		}
+	}
+	if got = FormatRecipients(nil); len(got) != 0 {
+		t.Fatal("expected no recipients, got", got)
+	}
+}
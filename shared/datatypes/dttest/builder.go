@@ -0,0 +1,137 @@
+/*
+Package dttest helps tests seed the database with users and their related
+data. It's intended only for tests, both Abot's own and plugins', and should
+never be imported by production code.
+*/
+package dttest
+
+import (
+	"fmt"
+
+	"github.com/itsabot/abot/shared/datatypes"
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// UserBuilder describes a user to be inserted into the database along with
+// their flexids and cards. Each method returns the builder so calls can be
+// chained:
+//
+//	u, err := dttest.NewUserBuilder().
+//		WithEmail("t@example.com").
+//		WithPhone("+13105555555").
+//		WithCard(dt.Card{Last4: "4242", Brand: "Visa"}).
+//		AsTrainer().
+//		Insert(db)
+type UserBuilder struct {
+	user   dt.User
+	phones []string
+	cards  []dt.Card
+}
+
+// NewUserBuilder returns a builder for a user named "Test" with the email
+// test@example.com and the password "password".
+func NewUserBuilder() *UserBuilder {
+	return &UserBuilder{user: dt.User{
+		Name:     "Test",
+		Email:    "test@example.com",
+		Password: "password",
+	}}
+}
+
+// WithName sets the user's name.
+func (b *UserBuilder) WithName(name string) *UserBuilder {
+	b.user.Name = name
+	return b
+}
+
+// WithEmail sets the user's email, which is also added as a verified email
+// flexid, as by dt.User.Create.
+func (b *UserBuilder) WithEmail(email string) *UserBuilder {
+	b.user.Email = email
+	return b
+}
+
+// WithPassword sets the user's password, which is hashed before saving.
+func (b *UserBuilder) WithPassword(password string) *UserBuilder {
+	b.user.Password = password
+	return b
+}
+
+// WithPhone adds a verified phone flexid. The phone may be in any format
+// accepted by dt.NormalizePhone.
+func (b *UserBuilder) WithPhone(phone string) *UserBuilder {
+	b.phones = append(b.phones, phone)
+	return b
+}
+
+// WithCard adds a card. If the card has no ServiceToken, a unique one is
+// generated.
+func (b *UserBuilder) WithCard(c dt.Card) *UserBuilder {
+	b.cards = append(b.cards, c)
+	return b
+}
+
+// AsTrainer grants the user access to the training interface.
+func (b *UserBuilder) AsTrainer() *UserBuilder {
+	b.user.Trainer = true
+	return b
+}
+
+// AsAdmin makes the user an admin.
+func (b *UserBuilder) AsAdmin() *UserBuilder {
+	b.user.Admin = true
+	return b
+}
+
+// Insert saves the user and all of their data in a single transaction,
+// returning the new user.
+func (b *UserBuilder) Insert(db *sqlx.DB) (*dt.User, error) {
+	u := b.user
+	err := dt.WithTx(db, func(tx *sqlx.Tx) error {
+		hpw, err := bcrypt.GenerateFromPassword([]byte(u.Password), 10)
+		if err != nil {
+			return err
+		}
+		q := `INSERT INTO users (name, email, password, locationid, admin,
+			trainer)
+		      VALUES ($1, $2, $3, 0, $4, $5)
+		      RETURNING id`
+		err = tx.QueryRowx(q, u.Name, u.Email, hpw, u.Admin,
+			u.Trainer).Scan(&u.ID)
+		if err != nil {
+			return fmt.Errorf("insert user: %s", err)
+		}
+		if err = u.AddFlexID(tx, u.Email, dt.FIDTEmail); err != nil {
+			return fmt.Errorf("add email %s: %s", u.Email, err)
+		}
+		for _, phone := range b.phones {
+			if phone, err = dt.NormalizePhone(phone); err != nil {
+				return err
+			}
+			if err = u.AddFlexID(tx, phone, dt.FIDTPhone); err != nil {
+				return fmt.Errorf("add phone %s: %s", phone, err)
+			}
+		}
+		q = `UPDATE userflexids SET verified=TRUE WHERE userid=$1`
+		if _, err = tx.Exec(q, u.ID); err != nil {
+			return fmt.Errorf("verify flexids: %s", err)
+		}
+		for i, c := range b.cards {
+			if c.CardholderName == "" {
+				c.CardholderName = u.Name
+			}
+			if c.ServiceToken == "" {
+				c.ServiceToken = fmt.Sprintf("tok_%d_%d", u.ID, i)
+			}
+			if _, err = u.AddCard(tx, &c); err != nil {
+				return fmt.Errorf("add card %s: %s", c.Last4, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
@@ -0,0 +1,75 @@
+package dttest
+
+import (
+	"os"
+	"testing"
+
+	"github.com/itsabot/abot/shared/datatypes"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+)
+
+func TestUserBuilder(t *testing.T) {
+	u := os.Getenv("ABOT_DATABASE_URL")
+	if u == "" || os.Getenv("ABOT_ENV") != "test" {
+		t.Skip(`ABOT_DATABASE_URL not set or ABOT_ENV != "test"`)
+	}
+	db, err := sqlx.Connect("postgres", u)
+	if err != nil {
+		t.Skip("failed to connect to db.", err)
+	}
+	const email = "builder@example.com"
+	if old, err := dt.GetUserByEmail(db, email); err == nil {
+		if err = old.Delete(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	user, err := NewUserBuilder().
+		WithName("Alice").
+		WithEmail(email).
+		WithPhone("(310) 555-5555").
+		WithCard(dt.Card{Last4: "4242", Brand: "Visa", ExpMonth: 8,
+			ExpYear: 2030}).
+		WithCard(dt.Card{Last4: "4444", Brand: "MasterCard", ExpMonth: 9,
+			ExpYear: 2031}).
+		AsTrainer().
+		Insert(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := user.Delete(db); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	got, err := dt.GetUserByEmail(db, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != user.ID || got.Name != "Alice" || !got.Trainer {
+		t.Fatalf("expected trainer Alice #%d, got %s trainer=%t", user.ID,
+			got, got.Trainer)
+	}
+	phone, err := got.GetPhone(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if phone != "+13105555555" {
+		t.Fatal("expected verified phone +13105555555, got", phone)
+	}
+	cards, err := got.GetCards(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cards) != 2 || cards[0].Last4 != "4242" ||
+		cards[1].Last4 != "4444" || cards[0].CardholderName != "Alice" {
+		t.Fatal("expected both cards, got", cards)
+	}
+
+	_, err = NewUserBuilder().WithEmail(email).Insert(db)
+	if err == nil {
+		t.Fatal("expected duplicate email to fail")
+	}
+}
@@ -0,0 +1,92 @@
+package dt
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+)
+
+// ValidEmail reports whether s is a bare email address suitable for storage,
+// e.g. "alice@example.com". s must parse as an RFC 5322 address without a
+// display name or angle brackets, have a single "@" and a non-empty local
+// part, and its domain must contain a "." which isn't at either end.
+func ValidEmail(s string) bool {
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Name != "" || addr.Address != s {
+		return false
+	}
+	parts := strings.Split(s, "@")
+	if len(parts) != 2 || len(parts[0]) == 0 {
+		return false
+	}
+	domain := parts[1]
+	return strings.Contains(domain, ".") &&
+		!strings.HasPrefix(domain, ".") && !strings.HasSuffix(domain, ".")
+}
+
+// ErrDisposableEmail is returned when an email address belongs to a disposable
+// email provider. See SetDisposableDomains.
+var ErrDisposableEmail = errors.New("disposable email")
+
+// disposableDomains holds the lowercased domains of disposable email providers
+// rejected by this deployment. When empty, every domain is allowed.
+var disposableDomains map[string]bool
+
+// SetDisposableDomains configures the disposable email providers whose
+// addresses are rejected by User.Create and User.ChangeEmail, e.g.
+// []string{"mailinator.com"}. Subdomains of each domain are rejected as well.
+// Passing an empty list allows every domain, which is the default. It should
+// be called during initialization, before any users are created.
+func SetDisposableDomains(domains []string) {
+	disposableDomains = map[string]bool{}
+	for _, d := range domains {
+		disposableDomains[strings.ToLower(strings.TrimSpace(d))] = true
+	}
+}
+
+// IsDisposableEmail reports whether the email address belongs to one of the
+// providers configured by SetDisposableDomains.
+func IsDisposableEmail(email string) bool {
+	if len(disposableDomains) == 0 {
+		return false
+	}
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return false
+	}
+	domain := strings.ToLower(strings.TrimSpace(email[i+1:]))
+	for domain != "" {
+		if disposableDomains[domain] {
+			return true
+		}
+		j := strings.Index(domain, ".")
+		if j < 0 {
+			break
+		}
+		domain = domain[j+1:]
+	}
+	return false
+}
+
+// spokenEmailWords maps words commonly heard when an email address is read
+// aloud to the characters they stand for.
+var spokenEmailWords = map[string]string{
+	"at":  "@",
+	"dot": ".",
+}
+
+// NormalizeSpokenEmail converts an email address transcribed from speech, e.g.
+// "John at gmail dot com.", into its written form, "john@gmail.com". Spoken
+// "at" and "dot" are replaced, whitespace is removed, and trailing punctuation
+// added by the transcription is trimmed. Written addresses pass through
+// unchanged except for being lowercased.
+func NormalizeSpokenEmail(raw string) string {
+	raw = strings.TrimRight(strings.TrimSpace(raw), ".,!?")
+	words := strings.Fields(strings.ToLower(raw))
+	for i, w := range words {
+		if c, ok := spokenEmailWords[w]; ok {
+			words[i] = c
+		}
+	}
+	return strings.Join(words, "")
+}
@@ -0,0 +1,102 @@
+package dt
+
+import "testing"
+
+func TestValidEmail(t *testing.T) {
+	tests := map[string]bool{
+		"alice@example.com":         true,
+		"Alice.Smith@example.co.uk": true,
+		"alice+abot@example.com":    true,
+		"alice@mail.example.org":    true,
+		"josé@example.com":          true,
+		"alice@bücher.de":           true,
+		"alice@例え.jp":               true,
+		"":                          false,
+		"alice":                     false,
+		"alice@":                    false,
+		"@example.com":              false,
+		"alice@example":             false,
+		"alice@.example.com":        false,
+		"alice@example.com.":        false,
+		"alice@@example.com":        false,
+		"alice@bob@example.com":     false,
+		"alice.@example.com":        false,
+		"alice smith@example.com":   false,
+		" alice@example.com":        false,
+		"John <j@example.com>":      false,
+		"<j@example.com>":           false,
+	}
+	for email, want := range tests {
+		if got := ValidEmail(email); got != want {
+			t.Fatalf("%q: expected %t, got %t", email, want, got)
+		}
+	}
+}
+
+func TestNormalizeSpokenEmail(t *testing.T) {
+	tests := []string{
+		"john.smith@gmail.com",
+		"John.Smith@Gmail.com",
+		"john.smith@gmail.com.",
+		"john dot smith at gmail dot com",
+		"John dot Smith at Gmail dot com.",
+		"  john  dot smith   at gmail dot  com ",
+		"john.smith at gmail.com",
+		"john dot smith@gmail dot com!",
+		"j o h n dot smith at gmail dot com",
+	}
+	for _, test := range tests {
+		got := NormalizeSpokenEmail(test)
+		if got != "john.smith@gmail.com" {
+			t.Fatalf("%q: expected john.smith@gmail.com, got %q", test,
+				got)
+		}
+	}
+	got := NormalizeSpokenEmail("matt at dotcom dot org")
+	if got != "matt@dotcom.org" {
+		t.Fatal("expected only whole words to be replaced, got", got)
+	}
+}
+
+func TestIsDisposableEmail(t *testing.T) {
+	if IsDisposableEmail("t@mailinator.com") {
+		t.Fatal("expected every domain to be allowed by default")
+	}
+	SetDisposableDomains([]string{"Mailinator.com", " 10minutemail.com "})
+	defer SetDisposableDomains(nil)
+	tests := map[string]bool{
+		"t@mailinator.com":         true,
+		"t@MAILINATOR.COM":         true,
+		"t@eu.10minutemail.com":    true,
+		"t@example.com":            false,
+		"t@notmailinator.com":      false,
+		"mailinator.com@gmail.com": false,
+		"mailinator.com":           false,
+	}
+	for email, want := range tests {
+		if got := IsDisposableEmail(email); got != want {
+			t.Fatalf("%q: expected %t, got %t", email, want, got)
+		}
+	}
+}
+
+func TestCreateRejectsDisposableEmail(t *testing.T) {
+	SetDisposableDomains([]string{"mailinator.com"})
+	defer SetDisposableDomains(nil)
+	// The email is rejected before the database is used, so a nil DB is
+	// safe to pass.
+	u := &User{Name: "t", Email: "t@mailinator.com", Password: "password"}
+	err := u.Create(nil, FIDTPhone, "+13105555555")
+	if err != ErrDisposableEmail {
+		t.Fatal("expected ErrDisposableEmail, got", err)
+	}
+	u = &User{ID: 1, Email: "t@example.com"}
+	err = u.ChangeEmail(nil, "u@mailinator.com")
+	if err != ErrDisposableEmail {
+		t.Fatal("expected ErrDisposableEmail, got", err)
+	}
+	u.Email = "u@mailinator.com"
+	if err = u.Update(nil); err != ErrDisposableEmail {
+		t.Fatal("expected ErrDisposableEmail, got", err)
+	}
+}
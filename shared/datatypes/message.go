@@ -3,8 +3,6 @@ package dt
 import (
 	"database/sql"
 	"time"
-
-	"github.com/jmoiron/sqlx"
 )
 
 // Msg is a message received by a user. It holds various fields that are useful
@@ -32,7 +30,8 @@ type Msg struct {
 }
 
 // GetMsg returns a message for a given message ID.
-func GetMsg(db *sqlx.DB, id uint64) (*Msg, error) {
+func GetMsg(db Queryer, id uint64) (_ *Msg, err error) {
+	defer observe("GetMsg", time.Now(), &err)
 	q := `SELECT id, sentence, abotsent
 	      FROM messages
 	      WHERE id=$1`
@@ -44,7 +43,8 @@ func GetMsg(db *sqlx.DB, id uint64) (*Msg, error) {
 }
 
 // Update a message as needing training.
-func (m *Msg) Update(db *sqlx.DB) error {
+func (m *Msg) Update(db Queryer) (err error) {
+	defer observe("Msg.Update", time.Now(), &err)
 	q := `UPDATE messages SET needstraining=$1 WHERE id=$2`
 	if _, err := db.Exec(q, m.NeedsTraining, m.ID); err != nil {
 		return err
@@ -53,7 +53,8 @@ func (m *Msg) Update(db *sqlx.DB) error {
 }
 
 // Save a message to the database, updating the message ID.
-func (m *Msg) Save(db *sqlx.DB) error {
+func (m *Msg) Save(db Queryer) (err error) {
+	defer observe("Msg.Save", time.Now(), &err)
 	var pluginName string
 	if m.Plugin != nil {
 		pluginName = m.Plugin.Config.Name
@@ -73,12 +74,12 @@ func (m *Msg) Save(db *sqlx.DB) error {
 
 // GetLastPlugin for a given user so the previous plugin can be called again if
 // no new trigger is detected.
-func (m *Msg) GetLastPlugin(db *sqlx.DB) (string, string, error) {
+func (m *Msg) GetLastPlugin(db Queryer) (_ string, _ string, err error) {
+	defer observe("Msg.GetLastPlugin", time.Now(), &err)
 	var res struct {
 		Plugin string
 		Route  string
 	}
-	var err error
 	if m.User.ID > 0 {
 		q := `SELECT route, plugin FROM messages
 		      WHERE userid=$1 AND abotsent IS FALSE
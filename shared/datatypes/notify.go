@@ -0,0 +1,189 @@
+package dt
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Mailer sends a plaintext email to a single recipient. It's satisfied by a
+// thin wrapper around an emailsender connection, and it lets notifications be
+// tested without an external email service.
+type Mailer interface {
+	Send(to, subj, body string) error
+}
+
+// NotifyError holds the errors encountered while notifying many recipients,
+// keyed by the recipient's address.
+type NotifyError map[string]error
+
+// Error lists each failed recipient with its error, sorted by recipient.
+func (e NotifyError) Error() string {
+	var tos []string
+	for to := range e {
+		tos = append(tos, to)
+	}
+	sort.Strings(tos)
+	msgs := make([]string, len(tos))
+	for i, to := range tos {
+		msgs[i] = to + ": " + e[to].Error()
+	}
+	return "failed to notify " + strings.Join(msgs, "; ")
+}
+
+// Texter sends an SMS to a single phone number. It's satisfied by an
+// sms.Conn.
+type Texter interface {
+	Send(to, msg string) error
+}
+
+// NotifyTrainers emails every trainer, e.g. when new training is required.
+// Trainers who prefer not to be contacted are skipped, and since no Texter is
+// available those preferring SMS are emailed instead. See
+// NotifyTrainersByPreference.
+func NotifyTrainers(db Queryer, m Mailer, subj, body string) error {
+	return NotifyTrainersByPreference(db, m, nil, subj, body)
+}
+
+// NotifyTrainersByPreference notifies every trainer through their preferred
+// channel, emailing those who haven't chosen one. Trainers preferring SMS are
+// emailed if t is nil or they have no verified phone. Failing to notify one
+// trainer doesn't prevent notifying the rest. Any failures are returned
+// together as a NotifyError.
+func NotifyTrainersByPreference(db Queryer, m Mailer, t Texter, subj,
+	body string) error {
+
+	trainers, err := ListTrainers(db)
+	if err != nil {
+		return err
+	}
+	errs := NotifyError{}
+	for _, u := range trainers {
+		switch u.contactPreference() {
+		case ContactNone:
+			continue
+		case ContactSMS:
+			// Breaking out of the switch falls back to email
+			if t == nil {
+				break
+			}
+			phone, err := u.GetPhone(db)
+			if err == ErrMissingFlexID {
+				break
+			}
+			if err == nil {
+				err = t.Send(phone, subj+"\n\n"+body)
+			}
+			if err != nil {
+				errs[u.Email] = err
+			}
+			continue
+		}
+		if err = m.Send(u.Email, subj, body); err != nil {
+			errs[u.Email] = err
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Notifier sends a message to a Contactable through a single channel.
+type Notifier interface {
+	Notify(c Contactable, msg string) error
+}
+
+// MissingContactError is returned by a Notifier when the recipient has no
+// contact information for its channel, e.g. no verified phone for SMS.
+type MissingContactError struct {
+	Channel ContactPreference
+}
+
+// Error names the missing contact information.
+func (e *MissingContactError) Error() string {
+	if e.Channel == ContactSMS {
+		return "missing contact info: no verified phone"
+	}
+	return "missing contact info: no email"
+}
+
+// EmailNotifier notifies by email, sending every message with the same
+// Subject.
+type EmailNotifier struct {
+	Mailer  Mailer
+	Subject string
+}
+
+// Notify emails msg to the recipient.
+func (n *EmailNotifier) Notify(c Contactable, msg string) error {
+	to := c.GetEmail()
+	if to == "" {
+		return &MissingContactError{Channel: ContactEmail}
+	}
+	return n.Mailer.Send(to, n.Subject, msg)
+}
+
+// phoneContactable is a Contactable which can also be reached by phone, such
+// as a *User.
+type phoneContactable interface {
+	Contactable
+	GetPhone(db Queryer) (string, error)
+}
+
+// SMSNotifier notifies by SMS, texting the recipient's verified phone as
+// returned by GetPhone.
+type SMSNotifier struct {
+	DB     Queryer
+	Texter Texter
+}
+
+// Notify texts msg to the recipient. A *MissingContactError is returned if the
+// recipient has no verified phone.
+func (n *SMSNotifier) Notify(c Contactable, msg string) error {
+	pc, ok := c.(phoneContactable)
+	if !ok {
+		return &MissingContactError{Channel: ContactSMS}
+	}
+	phone, err := pc.GetPhone(n.DB)
+	if err == ErrMissingFlexID {
+		return &MissingContactError{Channel: ContactSMS}
+	}
+	if err != nil {
+		return err
+	}
+	return n.Texter.Send(phone, msg)
+}
+
+// ErrMissingNotifier is returned by NotifyUser when no Notifier is given for
+// the channel through which the user must be notified.
+var ErrMissingNotifier = errors.New("missing notifier")
+
+// NotifyUser sends msg to the user through their PreferredContact. As with
+// NotifyTrainersByPreference, users preferring SMS are emailed if sms is nil or
+// they have no verified phone, and users preferring not to be contacted are
+// skipped. Either notifier may be nil, in which case ErrMissingNotifier is
+// returned if it's needed. A *MissingContactError is returned if the user
+// can't be reached.
+func NotifyUser(db Queryer, u *User, msg string, email, sms Notifier) error {
+	pref, err := u.PreferredContact(db)
+	if err != nil {
+		return err
+	}
+	switch pref {
+	case ContactNone:
+		return nil
+	case ContactSMS:
+		if sms == nil {
+			break
+		}
+		err = sms.Notify(u, msg)
+		if _, ok := err.(*MissingContactError); !ok || email == nil {
+			return err
+		}
+	}
+	if email == nil {
+		return ErrMissingNotifier
+	}
+	return email.Notify(u, msg)
+}
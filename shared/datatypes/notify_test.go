@@ -0,0 +1,217 @@
+package dt
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// fakeMailer records sent emails, failing to send to any address in fail.
+type fakeMailer struct {
+	sent map[string]string
+	fail map[string]bool
+}
+
+func (m *fakeMailer) Send(to, subj, body string) error {
+	if m.fail[to] {
+		return errors.New("bounced")
+	}
+	m.sent[to] = subj + ": " + body
+	return nil
+}
+
+// fakeTexter records sent SMS messages by phone number.
+type fakeTexter struct {
+	sent map[string]string
+}
+
+func (t *fakeTexter) Send(to, msg string) error {
+	t.sent[to] = msg
+	return nil
+}
+
+func TestNotifyError(t *testing.T) {
+	err := NotifyError{
+		"u@example.com": errors.New("bounced"),
+		"t@example.com": errors.New("timeout"),
+	}
+	expected := "failed to notify t@example.com: timeout; u@example.com: bounced"
+	if err.Error() != expected {
+		t.Fatalf("expected %q, got %q", expected, err.Error())
+	}
+}
+
+func TestNotifyTrainers(t *testing.T) {
+	requireDB(t)
+	for _, email := range []string{"t@example.com", "u@example.com",
+		"v@example.com"} {
+		u := seedUser(t, email)
+		if err := u.SetTrainer(testDB, email != "v@example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := &fakeMailer{sent: map[string]string{}}
+	if err := NotifyTrainers(testDB, m, "Training", "Hi"); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.sent) != 2 || m.sent["t@example.com"] != "Training: Hi" ||
+		m.sent["u@example.com"] != "Training: Hi" {
+		t.Fatal("expected both trainers to be emailed, got", m.sent)
+	}
+
+	m = &fakeMailer{
+		sent: map[string]string{},
+		fail: map[string]bool{"t@example.com": true},
+	}
+	err := NotifyTrainers(testDB, m, "Training", "Hi")
+	nerr, ok := err.(NotifyError)
+	if !ok || len(nerr) != 1 || nerr["t@example.com"] == nil {
+		t.Fatal("expected NotifyError for t@example.com, got", err)
+	}
+	if m.sent["u@example.com"] == "" {
+		t.Fatal("expected remaining trainer to be emailed")
+	}
+}
+
+func TestNotifyTrainersByPreference(t *testing.T) {
+	requireDB(t)
+	prefs := map[string]ContactPreference{
+		"t@example.com": 0,
+		"u@example.com": ContactEmail,
+		"v@example.com": ContactSMS,
+		"w@example.com": ContactSMS, // no verified phone
+		"x@example.com": ContactNone,
+	}
+	for email, pref := range prefs {
+		u := seedUser(t, email)
+		if err := u.SetTrainer(testDB, true); err != nil {
+			t.Fatal(err)
+		}
+		if pref != 0 {
+			if err := u.SetContactPreference(testDB, pref); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if email == "v@example.com" {
+			code, err := u.StartPhoneVerification(testDB, "+13105555555")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = u.ConfirmPhoneVerification(testDB, "+13105555555", code)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	m := &fakeMailer{sent: map[string]string{}}
+	tx := &fakeTexter{sent: map[string]string{}}
+	err := NotifyTrainersByPreference(testDB, m, tx, "Training", "Hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.sent) != 3 || m.sent["t@example.com"] == "" ||
+		m.sent["u@example.com"] == "" || m.sent["w@example.com"] == "" {
+		t.Fatal("expected t, u and w to be emailed, got", m.sent)
+	}
+	if len(tx.sent) != 1 || tx.sent["+13105555555"] != "Training\n\nHi" {
+		t.Fatal("expected v to be texted, got", tx.sent)
+	}
+
+	// Without a Texter, SMS falls back to email.
+	m = &fakeMailer{sent: map[string]string{}}
+	if err = NotifyTrainers(testDB, m, "Training", "Hi"); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.sent) != 4 || m.sent["x@example.com"] != "" {
+		t.Fatal("expected all but x to be emailed, got", m.sent)
+	}
+}
+
+func TestEmailNotifier(t *testing.T) {
+	m := &fakeMailer{sent: map[string]string{}}
+	n := &EmailNotifier{Mailer: m, Subject: "Abot"}
+	if err := n.Notify(&User{Email: "t@example.com"}, "Hi"); err != nil {
+		t.Fatal(err)
+	}
+	if m.sent["t@example.com"] != "Abot: Hi" {
+		t.Fatal("expected email to be sent, got", m.sent)
+	}
+	err := n.Notify(&User{}, "Hi")
+	if merr, ok := err.(*MissingContactError); !ok ||
+		merr.Channel != ContactEmail {
+		t.Fatal("expected *MissingContactError for email, got", err)
+	}
+}
+
+func TestNotifyUser(t *testing.T) {
+	requireDB(t)
+	users := map[ContactPreference]*User{}
+	for i, pref := range []ContactPreference{ContactEmail, ContactSMS,
+		ContactNone} {
+		u := seedUser(t, fmt.Sprintf("t%d@example.com", i))
+		if err := u.SetContactPreference(testDB, pref); err != nil {
+			t.Fatal(err)
+		}
+		users[pref] = u
+	}
+	m := &fakeMailer{sent: map[string]string{}}
+	tx := &fakeTexter{sent: map[string]string{}}
+	email := &EmailNotifier{Mailer: m, Subject: "Abot"}
+	sms := &SMSNotifier{DB: testDB, Texter: tx}
+
+	// Without a verified phone, SMS falls back to email.
+	for _, u := range users {
+		if err := NotifyUser(testDB, u, "Hi", email, sms); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(m.sent) != 2 || m.sent["t0@example.com"] == "" ||
+		m.sent["t1@example.com"] == "" || len(tx.sent) != 0 {
+		t.Fatal("expected 2 emails and no texts, got", m.sent, tx.sent)
+	}
+	err := sms.Notify(users[ContactSMS], "Hi")
+	if merr, ok := err.(*MissingContactError); !ok ||
+		merr.Channel != ContactSMS {
+		t.Fatal("expected *MissingContactError for SMS, got", err)
+	}
+	err = NotifyUser(testDB, users[ContactSMS], "Hi", nil, sms)
+	if merr, ok := err.(*MissingContactError); !ok ||
+		merr.Channel != ContactSMS {
+		t.Fatal("expected *MissingContactError without email, got", err)
+	}
+	for _, pref := range []ContactPreference{ContactEmail, ContactSMS} {
+		err = NotifyUser(testDB, users[pref], "Hi", nil, nil)
+		if err != ErrMissingNotifier {
+			t.Fatal("expected ErrMissingNotifier, got", err)
+		}
+	}
+
+	// Users are usually loaded through GetUser, which must carry their
+	// preference.
+	u, err := GetUser(testDB, &Request{UserID: users[ContactSMS].ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := u.StartPhoneVerification(testDB, "+13105555555")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = u.ConfirmPhoneVerification(testDB, "+13105555555", code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.sent = map[string]string{}
+	if err = NotifyUser(testDB, u, "Hi", email, sms); err != nil {
+		t.Fatal(err)
+	}
+	if tx.sent["+13105555555"] != "Hi" || len(m.sent) != 0 {
+		t.Fatal("expected a text and no email, got", tx.sent, m.sent)
+	}
+	tx.sent = map[string]string{}
+	if err = NotifyUser(testDB, u, "Hi", nil, sms); err != nil {
+		t.Fatal(err)
+	}
+	if tx.sent["+13105555555"] != "Hi" {
+		t.Fatal("expected a text without an email notifier, got", tx.sent)
+	}
+}
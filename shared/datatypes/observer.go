@@ -0,0 +1,34 @@
+package dt
+
+import "time"
+
+// Observer is notified after each database operation performed by the dt
+// package, e.g. to export query latencies as metrics. name identifies the
+// operation, like "GetUser" or "User.GetCards", and err is the error returned
+// to the caller, if any.
+type Observer interface {
+	ObserveQuery(name string, d time.Duration, err error)
+}
+
+// observer receives all database operations. It's nil unless set by
+// SetObserver.
+var observer Observer
+
+// SetObserver registers o to be notified of database operations. It should be
+// called once during initialization, before any queries are made. Passing nil
+// disables observation.
+func SetObserver(o Observer) {
+	observer = o
+}
+
+// observe reports an operation which began at start to the observer, if one
+// is set. It's designed to be deferred at the top of functions with a named
+// error result:
+//
+//	defer observe("GetUser", time.Now(), &err)
+func observe(name string, start time.Time, err *error) {
+	if observer == nil {
+		return
+	}
+	observer.ObserveQuery(name, time.Since(start), *err)
+}
@@ -0,0 +1,60 @@
+package dt
+
+import (
+	"testing"
+	"time"
+)
+
+type observation struct {
+	name string
+	d    time.Duration
+	err  error
+}
+
+// capturingObserver records every operation it's notified of.
+type capturingObserver struct {
+	observed []observation
+}
+
+func (o *capturingObserver) ObserveQuery(name string, d time.Duration,
+	err error) {
+	o.observed = append(o.observed, observation{name, d, err})
+}
+
+func TestObserver(t *testing.T) {
+	o := &capturingObserver{}
+	SetObserver(o)
+	defer SetObserver(nil)
+
+	db := &fakeQueryer{users: map[uint64]User{1: {ID: 1, Name: "t"}}}
+	if _, err := GetUser(db, &Request{UserID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	u := &User{ID: 1}
+	if _, _, err := u.GetCardsPaged(db, 0, 0); err != ErrInvalidPage {
+		t.Fatal("expected ErrInvalidPage, got", err)
+	}
+	expected := []observation{
+		{name: "GetUser"},
+		{name: "User.GetCardsPaged", err: ErrInvalidPage},
+	}
+	if len(o.observed) != len(expected) {
+		t.Fatal("expected", len(expected), "observations, got", o.observed)
+	}
+	for i, obs := range o.observed {
+		if obs.name != expected[i].name || obs.err != expected[i].err {
+			t.Fatalf("expected %+v, got %+v", expected[i], obs)
+		}
+		if obs.d < 0 {
+			t.Fatal("expected non-negative duration, got", obs.d)
+		}
+	}
+
+	SetObserver(nil)
+	if _, err := GetUser(db, &Request{UserID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if len(o.observed) != len(expected) {
+		t.Fatal("expected no observations after clearing the observer")
+	}
+}
@@ -1,7 +1,429 @@
 package dt
 
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
 // Phone represents a phone as a flexid from the database.
 type Phone struct {
 	ID     uint64
 	Number string `db:"flexid"`
 }
+
+// ErrInvalidPhone is returned when a string cannot be interpreted as a phone
+// number.
+var ErrInvalidPhone = errors.New("invalid phone number")
+
+// regexPhoneFormatting matches characters commonly used to format phone
+// numbers for display, e.g. "+1 (555) 555-5555".
+var regexPhoneFormatting = regexp.MustCompile(`[\s().\-/]`)
+
+// regexDigits matches a string made up entirely of digits.
+var regexDigits = regexp.MustCompile(`^[0-9]+$`)
+
+// NormalizePhone converts a phone number entered in any common format into
+// E.164, e.g. "+15555555555". Both "+" and the international "00" prefix are
+// recognized, and numbers with either are unaffected by the default region.
+// Numbers without them are national numbers in the region set by
+// SetDefaultPhoneRegion, which is the U.S. unless changed. For example,
+// "020 7946 0958" becomes "+442079460958" when the default region is "GB".
+func NormalizePhone(raw string) (string, error) {
+	s := regexPhoneFormatting.ReplaceAllString(raw, "")
+	switch {
+	case strings.HasPrefix(s, "+"):
+		s = s[1:]
+	case strings.HasPrefix(s, "00"):
+		s = s[2:]
+	case defaultPhoneCallingCode != "1":
+		// Drop the national trunk prefix, e.g. the leading 0 of UK
+		// numbers, before adding the calling code.
+		if !keepsTrunkZero[defaultPhoneRegion] {
+			s = strings.TrimPrefix(s, "0")
+		}
+		s = defaultPhoneCallingCode + s
+	case len(s) == 10:
+		s = "1" + s
+	case len(s) == 11 && s[0] == '1':
+		// North American number with country code but no "+"
+	default:
+		return "", ErrInvalidPhone
+	}
+	// E.164 numbers are at most 15 digits, and the country code never
+	// begins with 0.
+	if len(s) < 8 || len(s) > 15 || s[0] == '0' ||
+		!regexDigits.MatchString(s) {
+		return "", ErrInvalidPhone
+	}
+	return "+" + s, nil
+}
+
+// defaultPhoneRegion is the ISO country code of the region of national phone
+// numbers, and defaultPhoneCallingCode is its calling code. See
+// SetDefaultPhoneRegion.
+var (
+	defaultPhoneRegion      = "US"
+	defaultPhoneCallingCode = "1"
+)
+
+// keepsTrunkZero lists regions whose national numbers keep their leading 0
+// in international format.
+var keepsTrunkZero = map[string]bool{
+	"IT": true,
+}
+
+// SetDefaultPhoneRegion sets the region, as an ISO 3166-1 alpha-2 country code
+// like "GB", in which NormalizePhone interprets national numbers lacking a
+// country code. ErrUnknownPhoneRegion is returned for regions PhoneRegion
+// can't classify. The default is "US". It should be called during
+// initialization, before any phone numbers are normalized.
+func SetDefaultPhoneRegion(iso string) error {
+	iso = strings.ToUpper(strings.TrimSpace(iso))
+	code, ok := regionCallingCode(iso)
+	if !ok {
+		return ErrUnknownPhoneRegion
+	}
+	defaultPhoneRegion, defaultPhoneCallingCode = iso, code
+	return nil
+}
+
+// regionCallingCode returns the calling code for the region.
+func regionCallingCode(iso string) (string, bool) {
+	for code, region := range phoneRegions {
+		if region == iso {
+			return code, true
+		}
+	}
+	for _, region := range nanpRegions {
+		if region == iso {
+			return "1", true
+		}
+	}
+	return "", false
+}
+
+// ErrUnknownPhoneRegion is returned when the country of a phone number can't
+// be determined from its country calling code.
+var ErrUnknownPhoneRegion = errors.New("unknown phone region")
+
+// phoneRegions maps country calling codes to ISO 3166-1 alpha-2 country codes.
+// Calling codes shared by several countries map to the most populous one, with
+// exceptions for +1 listed in nanpRegions.
+var phoneRegions = map[string]string{
+	"1":   "US",
+	"7":   "RU",
+	"20":  "EG",
+	"27":  "ZA",
+	"30":  "GR",
+	"31":  "NL",
+	"32":  "BE",
+	"33":  "FR",
+	"34":  "ES",
+	"36":  "HU",
+	"39":  "IT",
+	"40":  "RO",
+	"41":  "CH",
+	"43":  "AT",
+	"44":  "GB",
+	"45":  "DK",
+	"46":  "SE",
+	"47":  "NO",
+	"48":  "PL",
+	"49":  "DE",
+	"51":  "PE",
+	"52":  "MX",
+	"54":  "AR",
+	"55":  "BR",
+	"56":  "CL",
+	"57":  "CO",
+	"60":  "MY",
+	"61":  "AU",
+	"62":  "ID",
+	"63":  "PH",
+	"64":  "NZ",
+	"65":  "SG",
+	"66":  "TH",
+	"81":  "JP",
+	"82":  "KR",
+	"84":  "VN",
+	"86":  "CN",
+	"90":  "TR",
+	"91":  "IN",
+	"92":  "PK",
+	"234": "NG",
+	"254": "KE",
+	"351": "PT",
+	"353": "IE",
+	"358": "FI",
+	"420": "CZ",
+	"852": "HK",
+	"886": "TW",
+	"966": "SA",
+	"971": "AE",
+	"972": "IL",
+}
+
+// nanpRegions maps the area codes of countries other than the U.S. which share
+// the +1 calling code.
+var nanpRegions = map[string]string{
+	"204": "CA", "226": "CA", "236": "CA", "249": "CA", "250": "CA",
+	"263": "CA", "289": "CA", "306": "CA", "343": "CA", "354": "CA",
+	"365": "CA", "367": "CA", "368": "CA", "382": "CA", "403": "CA",
+	"416": "CA", "418": "CA", "428": "CA", "431": "CA", "437": "CA",
+	"438": "CA", "450": "CA", "468": "CA", "474": "CA", "506": "CA",
+	"514": "CA", "519": "CA", "548": "CA", "579": "CA", "581": "CA",
+	"584": "CA", "587": "CA", "604": "CA", "613": "CA", "639": "CA",
+	"647": "CA", "672": "CA", "683": "CA", "705": "CA", "709": "CA",
+	"742": "CA", "753": "CA", "778": "CA", "780": "CA", "782": "CA",
+	"807": "CA", "819": "CA", "825": "CA", "867": "CA", "873": "CA",
+	"879": "CA", "902": "CA", "905": "CA",
+	"242": "BS", "246": "BB", "441": "BM", "787": "PR", "939": "PR",
+	"809": "DO", "829": "DO", "849": "DO", "868": "TT", "876": "JM",
+	"658": "JM",
+}
+
+// PhoneRegion returns the ISO 3166-1 alpha-2 country code, e.g. "US" or "GB",
+// of an E.164 phone number such as one returned by NormalizePhone.
+// ErrInvalidPhone is returned if the number isn't in E.164 format, and
+// ErrUnknownPhoneRegion if its calling code isn't recognized.
+func PhoneRegion(e164 string) (string, error) {
+	if n, err := NormalizePhone(e164); err != nil || n != e164 {
+		return "", ErrInvalidPhone
+	}
+	digits := e164[1:]
+	// Calling codes are prefix-free, so at most one of these matches.
+	for i := 1; i <= 3; i++ {
+		region, ok := phoneRegions[digits[:i]]
+		if !ok {
+			continue
+		}
+		if region == "US" && len(digits) >= 4 {
+			if r, ok := nanpRegions[digits[1:4]]; ok {
+				region = r
+			}
+		}
+		return region, nil
+	}
+	return "", ErrUnknownPhoneRegion
+}
+
+// PhoneVerificationTTL is how long a phone verification code remains valid
+// after it's sent.
+const PhoneVerificationTTL = 10 * time.Minute
+
+// phoneVerificationDigits is the length of a phone verification code.
+const phoneVerificationDigits = 6
+
+// ErrInvalidVerificationCode is returned when a phone verification code does
+// not match the code most recently sent to that phone.
+var ErrInvalidVerificationCode = errors.New("invalid verification code")
+
+// PhoneVerificationMaxAttempts is how many wrong codes may be entered for a
+// phone verification before it's invalidated, so codes can't be guessed.
+const PhoneVerificationMaxAttempts = 5
+
+// ErrTooManyVerificationAttempts is returned when a phone verification has
+// been invalidated after PhoneVerificationMaxAttempts wrong codes.
+var ErrTooManyVerificationAttempts = errors.New(
+	"too many verification attempts")
+
+// ErrVerificationExpired is returned when a phone verification code matches
+// but was sent more than PhoneVerificationTTL ago.
+var ErrVerificationExpired = errors.New("verification code expired")
+
+// PhoneVerificationCooldown is how long a user must wait after a verification
+// code is sent before StartPhoneVerification will send another.
+const PhoneVerificationCooldown = 30 * time.Second
+
+// CooldownError is returned when a verification code is requested too soon
+// after the last one was sent.
+type CooldownError struct {
+	Remaining time.Duration
+}
+
+// Error reports how long to wait before trying again.
+func (e *CooldownError) Error() string {
+	return fmt.Sprintf("try again in %s", e.Remaining)
+}
+
+// CanRequestAuth reports whether cooldown has passed since a verification code
+// was last sent to any of the user's phones and, if not, how much of the
+// cooldown remains. Only codes which haven't yet been confirmed are counted.
+func (u *User) CanRequestAuth(db Queryer, cooldown time.Duration) (_ bool,
+	_ time.Duration, err error) {
+
+	defer observe("User.CanRequestAuth", time.Now(), &err)
+	var ms sql.NullInt64
+	q := `SELECT CAST(1000 * EXTRACT(EPOCH FROM
+		MAX(createdat) + $2::INTERVAL - CURRENT_TIMESTAMP) AS BIGINT)
+	      FROM phoneverifications WHERE userid=$1`
+	if err = db.Get(&ms, q, u.ID, pgInterval(cooldown)); err != nil {
+		return false, 0, err
+	}
+	if !ms.Valid || ms.Int64 <= 0 {
+		return true, 0, nil
+	}
+	return false, time.Duration(ms.Int64) * time.Millisecond, nil
+}
+
+// StartPhoneVerification adds the phone to the user as an unverified flexid
+// and generates a numeric code to be sent to it. Starting a new verification
+// replaces any code previously sent to the same phone, along with its failed
+// attempts. The phone is not returned by GetPhone until
+// ConfirmPhoneVerification succeeds. A *CooldownError is returned if a code
+// was sent to any of the user's phones within the last
+// PhoneVerificationCooldown, and ErrMissingUser if the user doesn't exist.
+// The user's row is locked while the cooldown is checked, so concurrent
+// requests can't both send a code.
+func (u *User) StartPhoneVerification(db *sqlx.DB, phone string) (_ string,
+	err error) {
+
+	defer observe("User.StartPhoneVerification", time.Now(), &err)
+	phone, err = NormalizePhone(phone)
+	if err != nil {
+		return "", err
+	}
+	code, err := verificationCode()
+	if err != nil {
+		return "", err
+	}
+	err = inTx(db, func(tx Queryer) error {
+		var uid uint64
+		q := `SELECT id FROM users WHERE id=$1 FOR UPDATE`
+		err := tx.Get(&uid, q, u.ID)
+		if err == sql.ErrNoRows {
+			return ErrMissingUser
+		}
+		if err != nil {
+			return err
+		}
+		ok, remaining, err := u.CanRequestAuth(tx,
+			PhoneVerificationCooldown)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return &CooldownError{Remaining: remaining}
+		}
+		if err = u.AddFlexID(tx, phone, FIDTPhone); err != nil {
+			return err
+		}
+		q = `DELETE FROM phoneverifications WHERE userid=$1 AND flexid=$2`
+		if _, err = tx.Exec(q, u.ID, phone); err != nil {
+			return fmt.Errorf("delete phone verification: %s", err)
+		}
+		q = `INSERT INTO phoneverifications
+			(userid, flexid, code, expiresat)
+		     VALUES ($1, $2, $3, CURRENT_TIMESTAMP + $4::INTERVAL)`
+		_, err = tx.Exec(q, u.ID, phone, code,
+			pgInterval(PhoneVerificationTTL))
+		if err != nil {
+			return fmt.Errorf("insert phone verification: %s", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// ConfirmPhoneVerification checks the code sent to the phone by
+// StartPhoneVerification and, if it matches, marks the phone verified. Each
+// code can be used only once. ErrInvalidVerificationCode is returned for a
+// wrong code or a phone with no pending verification, and
+// ErrVerificationExpired for a correct code that has expired. After
+// PhoneVerificationMaxAttempts wrong codes, the code is invalidated and
+// ErrTooManyVerificationAttempts is returned until a new code is started.
+func (u *User) ConfirmPhoneVerification(db *sqlx.DB, phone, code string) (
+	err error) {
+
+	defer observe("User.ConfirmPhoneVerification", time.Now(), &err)
+	phone, err = NormalizePhone(phone)
+	if err != nil {
+		return err
+	}
+	// Failed attempts must be saved, so they're reported through result
+	// rather than by rolling back.
+	var result error
+	err = WithTx(db, func(tx *sqlx.Tx) error {
+		var v struct {
+			Code     string
+			Valid    bool
+			Attempts int
+		}
+		q := `SELECT code, expiresat > CURRENT_TIMESTAMP AS valid,
+			attempts
+		      FROM phoneverifications WHERE userid=$1 AND flexid=$2
+		      FOR UPDATE`
+		err := tx.Get(&v, q, u.ID, phone)
+		if err == sql.ErrNoRows {
+			result = ErrInvalidVerificationCode
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("get phone verification: %s", err)
+		}
+		if v.Attempts >= PhoneVerificationMaxAttempts {
+			result = ErrTooManyVerificationAttempts
+			return nil
+		}
+		if !secureEqual(v.Code, strings.TrimSpace(code)) {
+			q = `UPDATE phoneverifications SET attempts=attempts+1
+			     WHERE userid=$1 AND flexid=$2`
+			if _, err = tx.Exec(q, u.ID, phone); err != nil {
+				return fmt.Errorf("count failed attempt: %s", err)
+			}
+			result = ErrInvalidVerificationCode
+			if v.Attempts+1 >= PhoneVerificationMaxAttempts {
+				result = ErrTooManyVerificationAttempts
+			}
+			return nil
+		}
+		if !v.Valid {
+			result = ErrVerificationExpired
+			return nil
+		}
+		q = `UPDATE userflexids SET verified=TRUE
+		     WHERE userid=$1 AND flexid=$2 AND flexidtype=$3`
+		if _, err = tx.Exec(q, u.ID, phone, FIDTPhone); err != nil {
+			return fmt.Errorf("verify phone: %s", err)
+		}
+		q = `DELETE FROM phoneverifications WHERE userid=$1 AND flexid=$2`
+		if _, err = tx.Exec(q, u.ID, phone); err != nil {
+			return fmt.Errorf("delete phone verification: %s", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		// Verified flexids take precedence, so the phone may now
+		// resolve to this user.
+		invalidateCachedFlexID(phone, FIDTPhone)
+	}
+	return result
+}
+
+// verificationCode returns a random, zero-padded numeric code of
+// phoneVerificationDigits digits.
+func verificationCode() (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < phoneVerificationDigits; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", phoneVerificationDigits, n), nil
+}
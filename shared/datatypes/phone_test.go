@@ -0,0 +1,262 @@
+package dt
+
+import "testing"
+
+func TestNormalizePhone(t *testing.T) {
+	tests := map[string]string{
+		"+13105555555":      "+13105555555",
+		"+1 (310) 555-5555": "+13105555555",
+		"(310) 555-5555":    "+13105555555",
+		"310.555.5555":      "+13105555555",
+		"310 555 5555":      "+13105555555",
+		"1-310-555-5555":    "+13105555555",
+		"13105555555":       "+13105555555",
+		" 310-555-5555 ":    "+13105555555",
+		"+44 20 7946 0958":  "+442079460958",
+		"0044 20 7946 0958": "+442079460958",
+		"555-5555":          "",
+		"310-555-55555":     "",
+		"+1 310 555 CALL":   "",
+		"+0123456789":       "",
+		"+1234567890123456": "",
+		"t@example.com":     "",
+		"":                  "",
+	}
+	for raw, want := range tests {
+		got, err := NormalizePhone(raw)
+		if want == "" {
+			if err != ErrInvalidPhone {
+				t.Fatalf("%q: expected ErrInvalidPhone, got %q, %v",
+					raw, got, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %s", raw, err)
+		}
+		if got != want {
+			t.Fatalf("%q: expected %q, got %q", raw, want, got)
+		}
+	}
+}
+
+func TestSetDefaultPhoneRegion(t *testing.T) {
+	defer func() {
+		if err := SetDefaultPhoneRegion("US"); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	tests := map[string]map[string]string{
+		"US": {
+			"020 7946 0958":    "",
+			"(310) 555-5555":   "+13105555555",
+			"+44 20 7946 0958": "+442079460958",
+		},
+		"gb": {
+			"020 7946 0958":     "+442079460958",
+			"07700 900123":      "+447700900123",
+			"(310) 555-5555":    "+443105555555",
+			"+1 310 555 5555":   "+13105555555",
+			"0044 20 7946 0958": "+442079460958",
+		},
+		"IT": {
+			"06 6982 1234": "+390669821234",
+		},
+		"CA": {
+			"(416) 555-5555": "+14165555555",
+		},
+	}
+	for region, numbers := range tests {
+		if err := SetDefaultPhoneRegion(region); err != nil {
+			t.Fatal(err)
+		}
+		for raw, want := range numbers {
+			got, err := NormalizePhone(raw)
+			if want == "" {
+				if err != ErrInvalidPhone {
+					t.Fatalf("%s %q: expected ErrInvalidPhone, "+
+						"got %q", region, raw, got)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s %q: %s", region, raw, err)
+			}
+			if got != want {
+				t.Fatalf("%s %q: expected %q, got %q", region, raw,
+					want, got)
+			}
+		}
+	}
+	if err := SetDefaultPhoneRegion("XX"); err != ErrUnknownPhoneRegion {
+		t.Fatal("expected ErrUnknownPhoneRegion, got", err)
+	}
+}
+
+func TestPhoneRegion(t *testing.T) {
+	tests := map[string]struct {
+		region string
+		err    error
+	}{
+		"+13105555555":  {"US", nil},
+		"+14165555555":  {"CA", nil},
+		"+18765555555":  {"JM", nil},
+		"+442079460958": {"GB", nil},
+		"+353015555555": {"IE", nil},
+		"+33155555555":  {"FR", nil},
+		"+61255555555":  {"AU", nil},
+		"+99955555555":  {"", ErrUnknownPhoneRegion},
+		"3105555555":    {"", ErrInvalidPhone},
+		"+1 310 555 55": {"", ErrInvalidPhone},
+		"":              {"", ErrInvalidPhone},
+	}
+	for phone, want := range tests {
+		region, err := PhoneRegion(phone)
+		if region != want.region || err != want.err {
+			t.Fatalf("%q: expected %q, %v, got %q, %v", phone,
+				want.region, want.err, region, err)
+		}
+	}
+}
+
+func TestPhoneVerification(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	code, err := u.StartPhoneVerification(testDB, "(310) 555-5555")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code) != phoneVerificationDigits {
+		t.Fatal("expected a 6-digit code, got", code)
+	}
+	if _, err = u.GetPhone(testDB); err != ErrMissingFlexID {
+		t.Fatal("expected unverified phone to be hidden, got", err)
+	}
+	err = u.ConfirmPhoneVerification(testDB, "+13105555555", code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	phone, err := u.GetPhone(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if phone != "+13105555555" {
+		t.Fatal("expected +13105555555, got", phone)
+	}
+	err = u.ConfirmPhoneVerification(testDB, "+13105555555", code)
+	if err != ErrInvalidVerificationCode {
+		t.Fatal("expected code to be single-use, got", err)
+	}
+}
+
+func TestPhoneVerificationRejected(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	const phone = "+13105555555"
+	err := u.ConfirmPhoneVerification(testDB, phone, "123456")
+	if err != ErrInvalidVerificationCode {
+		t.Fatal("expected ErrInvalidVerificationCode with no code sent, got",
+			err)
+	}
+	code, err := u.StartPhoneVerification(testDB, phone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong := "000000"
+	if code == wrong {
+		wrong = "000001"
+	}
+	err = u.ConfirmPhoneVerification(testDB, phone, wrong)
+	if err != ErrInvalidVerificationCode {
+		t.Fatal("expected ErrInvalidVerificationCode, got", err)
+	}
+	q := `UPDATE phoneverifications
+	      SET expiresat=CURRENT_TIMESTAMP - INTERVAL '1 minute'
+	      WHERE userid=$1`
+	if _, err = testDB.Exec(q, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	err = u.ConfirmPhoneVerification(testDB, phone, code)
+	if err != ErrVerificationExpired {
+		t.Fatal("expected ErrVerificationExpired, got", err)
+	}
+	if _, err = u.GetPhone(testDB); err != ErrMissingFlexID {
+		t.Fatal("expected phone to remain unverified, got", err)
+	}
+}
+
+func TestPhoneVerificationMaxAttempts(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	const phone = "+13105555555"
+	code, err := u.StartPhoneVerification(testDB, phone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong := "000000"
+	if code == wrong {
+		wrong = "000001"
+	}
+	for i := 1; i <= PhoneVerificationMaxAttempts; i++ {
+		exp := ErrInvalidVerificationCode
+		if i == PhoneVerificationMaxAttempts {
+			exp = ErrTooManyVerificationAttempts
+		}
+		err = u.ConfirmPhoneVerification(testDB, phone, wrong)
+		if err != exp {
+			t.Fatalf("attempt %d: expected %v, got %v", i, exp, err)
+		}
+	}
+	err = u.ConfirmPhoneVerification(testDB, phone, code)
+	if err != ErrTooManyVerificationAttempts {
+		t.Fatal("expected invalidated code to be rejected, got", err)
+	}
+	if _, err = u.GetPhone(testDB); err != ErrMissingFlexID {
+		t.Fatal("expected phone to remain unverified, got", err)
+	}
+}
+
+func TestPhoneVerificationCooldown(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	ok, _, err := u.CanRequestAuth(testDB, PhoneVerificationCooldown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected first request to be allowed")
+	}
+	if _, err = u.StartPhoneVerification(testDB, "+13105555555"); err != nil {
+		t.Fatal(err)
+	}
+	ok, remaining, err := u.CanRequestAuth(testDB, PhoneVerificationCooldown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok || remaining <= 0 || remaining > PhoneVerificationCooldown {
+		t.Fatal("expected request within cooldown to be blocked, got", ok,
+			remaining)
+	}
+	_, err = u.StartPhoneVerification(testDB, "+13105555556")
+	if _, ok := err.(*CooldownError); !ok {
+		t.Fatal("expected *CooldownError, got", err)
+	}
+
+	q := `UPDATE phoneverifications
+	      SET createdat=CURRENT_TIMESTAMP - INTERVAL '1 minute'
+	      WHERE userid=$1`
+	if _, err = testDB.Exec(q, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	ok, remaining, err = u.CanRequestAuth(testDB, PhoneVerificationCooldown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || remaining != 0 {
+		t.Fatal("expected request after cooldown to be allowed, got", ok,
+			remaining)
+	}
+	if _, err = u.StartPhoneVerification(testDB, "+13105555556"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,102 @@
+package dt
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrMissingPrefKey is returned when a preference key is empty.
+var ErrMissingPrefKey = errors.New("missing preference key")
+
+// SetPref saves a small per-user setting under key, replacing any value
+// already saved there. Keys are shared by every plugin, so plugins should
+// prefix their keys with their name to avoid collisions, e.g.
+// "restaurant_tip_percent".
+func (u *User) SetPref(db Queryer, key, value string) (err error) {
+	defer observe("User.SetPref", time.Now(), &err)
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return ErrMissingPrefKey
+	}
+	q := `INSERT INTO userprefs (userid, key, value) VALUES ($1, $2, $3)
+	      ON CONFLICT (userid, key) DO UPDATE SET value=$3`
+	_, err = db.Exec(q, u.ID, key, value)
+	return err
+}
+
+// GetPref returns the setting saved under key by SetPref. The bool result is
+// false if no value has been saved.
+func (u *User) GetPref(db Queryer, key string) (_ string, _ bool, err error) {
+	defer observe("User.GetPref", time.Now(), &err)
+	var value string
+	q := `SELECT value FROM userprefs WHERE userid=$1 AND key=$2`
+	err = db.Get(&value, q, u.ID, strings.TrimSpace(key))
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// GetPrefs returns every setting saved for the user, mapped by key.
+func (u *User) GetPrefs(db Queryer) (_ map[string]string, err error) {
+	defer observe("User.GetPrefs", time.Now(), &err)
+	var rows []struct {
+		Key   string
+		Value string
+	}
+	q := `SELECT key, value FROM userprefs WHERE userid=$1`
+	if err = db.Select(&rows, q, u.ID); err != nil {
+		return nil, err
+	}
+	prefs := make(map[string]string, len(rows))
+	for _, r := range rows {
+		prefs[r.Key] = r.Value
+	}
+	return prefs, nil
+}
+
+// PrefTypeError is returned by GetPrefJSON when the saved value can't be
+// decoded into the destination, e.g. because it was saved by SetPref or with
+// a different type.
+type PrefTypeError struct {
+	Key string
+	Err error
+}
+
+// Error describes the key and the decoding error.
+func (e *PrefTypeError) Error() string {
+	return fmt.Sprintf("preference %q: %s", e.Key, e.Err)
+}
+
+// SetPrefJSON saves v encoded as JSON under key, so that structured settings
+// can be saved together. See SetPref.
+func (u *User) SetPrefJSON(db Queryer, key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return u.SetPref(db, key, string(b))
+}
+
+// GetPrefJSON decodes the JSON saved under key by SetPrefJSON into dest. The
+// bool result is false if no value has been saved. A *PrefTypeError is
+// returned if the value can't be decoded into dest.
+func (u *User) GetPrefJSON(db Queryer, key string, dest interface{}) (bool,
+	error) {
+
+	v, ok, err := u.GetPref(db, key)
+	if err != nil || !ok {
+		return false, err
+	}
+	if err = json.Unmarshal([]byte(v), dest); err != nil {
+		return true, &PrefTypeError{Key: key, Err: err}
+	}
+	return true, nil
+}
@@ -0,0 +1,88 @@
+package dt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPrefs(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	other := seedUser(t, "u@example.com")
+	if _, ok, err := u.GetPref(testDB, "tip"); err != nil || ok {
+		t.Fatal("expected missing key, got", ok, err)
+	}
+	for _, kv := range [][2]string{
+		{"tip", "15"},
+		{"restaurant", "Nopa"},
+		{"tip", "20"},
+	} {
+		if err := u.SetPref(testDB, kv[0], kv[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := other.SetPref(testDB, "tip", "10"); err != nil {
+		t.Fatal(err)
+	}
+	v, ok, err := u.GetPref(testDB, "tip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || v != "20" {
+		t.Fatal("expected overwritten tip 20, got", v, ok)
+	}
+	prefs, err := u.GetPrefs(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"tip": "20", "restaurant": "Nopa"}
+	if !reflect.DeepEqual(prefs, expected) {
+		t.Fatalf("expected %v, got %v", expected, prefs)
+	}
+	if err = u.SetPref(testDB, " ", "v"); err != ErrMissingPrefKey {
+		t.Fatal("expected ErrMissingPrefKey, got", err)
+	}
+}
+
+func TestPrefJSON(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	type settings struct {
+		Restaurants []string
+		TipPercent  int
+		Delivery    bool
+	}
+	var got settings
+	ok, err := u.GetPrefJSON(testDB, "settings", &got)
+	if err != nil || ok {
+		t.Fatal("expected missing key, got", ok, err)
+	}
+	expected := settings{
+		Restaurants: []string{"Nopa", "Zuni"},
+		TipPercent:  20,
+		Delivery:    true,
+	}
+	if err = u.SetPrefJSON(testDB, "settings", expected); err != nil {
+		t.Fatal(err)
+	}
+	ok, err = u.GetPrefJSON(testDB, "settings", &got)
+	if err != nil || !ok {
+		t.Fatal("expected saved settings, got", ok, err)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, got)
+	}
+
+	if err = u.SetPref(testDB, "tip", "twenty"); err != nil {
+		t.Fatal(err)
+	}
+	var tip int
+	_, err = u.GetPrefJSON(testDB, "tip", &tip)
+	if perr, ok := err.(*PrefTypeError); !ok || perr.Key != "tip" {
+		t.Fatal("expected *PrefTypeError for tip, got", err)
+	}
+	_, err = u.GetPrefJSON(testDB, "settings", &tip)
+	if _, ok := err.(*PrefTypeError); !ok {
+		t.Fatal("expected *PrefTypeError for mismatched type, got", err)
+	}
+}
@@ -0,0 +1,176 @@
+package dt
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Queryer is the subset of *sqlx.DB used to read and write datatypes. Both
+// *sqlx.DB and *sqlx.Tx satisfy it, so functions accepting a Queryer can run
+// either directly against the database or as part of a larger transaction.
+// Functions which manage their own transaction continue to require a
+// *sqlx.DB.
+type Queryer interface {
+	Get(dest interface{}, query string, args ...interface{}) error
+	Select(dest interface{}, query string, args ...interface{}) error
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRowx(query string, args ...interface{}) *sqlx.Row
+}
+
+var (
+	_ Queryer = (*sqlx.DB)(nil)
+	_ Queryer = (*sqlx.Tx)(nil)
+)
+
+// WithTx runs fn inside a transaction, committing if fn returns nil and
+// rolling back otherwise. The transaction is also rolled back if fn panics, in
+// which case the panic is propagated.
+func WithTx(db *sqlx.DB, fn func(tx *sqlx.Tx) error) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	txHooks.Lock()
+	txHooks.m[tx] = nil
+	txHooks.Unlock()
+	defer func() {
+		if p := recover(); p != nil {
+			popTxHooks(tx)
+			_ = tx.Rollback()
+			panic(p)
+		}
+	}()
+	if err = fn(tx); err != nil {
+		popTxHooks(tx)
+		_ = tx.Rollback()
+		return err
+	}
+	hooks := popTxHooks(tx)
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	for _, hook := range hooks {
+		hook()
+	}
+	return nil
+}
+
+// txHooks holds the functions to run once each transaction begun by WithTx
+// commits.
+var txHooks = struct {
+	sync.Mutex
+	m map[*sqlx.Tx][]func()
+}{m: map[*sqlx.Tx][]func(){}}
+
+// afterCommit runs fn once db's changes are visible to other connections. If
+// db is a transaction begun by WithTx, fn is deferred until it commits and
+// dropped if it rolls back. Otherwise fn runs right away.
+func afterCommit(db Queryer, fn func()) {
+	if tx, ok := db.(*sqlx.Tx); ok {
+		txHooks.Lock()
+		hooks, ok := txHooks.m[tx]
+		if ok {
+			txHooks.m[tx] = append(hooks, fn)
+		}
+		txHooks.Unlock()
+		if ok {
+			return
+		}
+	}
+	fn()
+}
+
+// popTxHooks returns and forgets the functions deferred by afterCommit for tx.
+func popTxHooks(tx *sqlx.Tx) []func() {
+	txHooks.Lock()
+	defer txHooks.Unlock()
+	hooks := txHooks.m[tx]
+	delete(txHooks.m, tx)
+	return hooks
+}
+
+// inTx runs fn inside a new transaction if db is a *sqlx.DB. Otherwise db is
+// assumed to be a transaction already, so fn runs with it directly.
+func inTx(db Queryer, fn func(tx Queryer) error) error {
+	if d, ok := db.(*sqlx.DB); ok {
+		return WithTx(d, func(tx *sqlx.Tx) error {
+			return fn(tx)
+		})
+	}
+	return fn(db)
+}
+
+// PingTimeout is how long Ping waits for the database to respond.
+const PingTimeout = 2 * time.Second
+
+// ErrPingTimeout is returned by Ping when the database doesn't respond within
+// PingTimeout.
+var ErrPingTimeout = errors.New("database ping timed out")
+
+// pingCall is a ping in flight against a Queryer. err is set before done is
+// closed.
+type pingCall struct {
+	done chan struct{}
+	err  error
+}
+
+// pings maps each Queryer to its ping in flight, if any.
+var (
+	pingsMu sync.Mutex
+	pings   = map[Queryer]*pingCall{}
+)
+
+// Ping checks that the database is reachable by running a trivial query,
+// returning ErrPingTimeout if it takes longer than PingTimeout. It's designed
+// for readiness probes.
+//
+// Without a context, a query that times out can't be cancelled, so it keeps
+// running and holding its connection until the database responds. Pings made
+// in the meantime wait on that same query rather than starting another, so a
+// hung database ties up at most one goroutine and connection per Queryer.
+func Ping(db Queryer) (err error) {
+	defer observe("Ping", time.Now(), &err)
+	return ping(db, PingTimeout)
+}
+
+// ping is Ping with a configurable timeout.
+func ping(db Queryer, timeout time.Duration) error {
+	pingsMu.Lock()
+	c, ok := pings[db]
+	if !ok {
+		c = &pingCall{done: make(chan struct{})}
+		pings[db] = c
+		go func() {
+			var n int
+			c.err = db.Get(&n, `SELECT 1`)
+			pingsMu.Lock()
+			delete(pings, db)
+			pingsMu.Unlock()
+			close(c.done)
+		}()
+	}
+	pingsMu.Unlock()
+	select {
+	case <-c.done:
+		return c.err
+	case <-time.After(timeout):
+		return ErrPingTimeout
+	}
+}
+
+// SchemaVersion returns the version of the newest migration applied to the
+// database, which is the timestamp at the start of its filename in
+// base/db/migrations/up, e.g. 1467331200. The version is recorded in the
+// schemaversion table after migrations are run.
+func SchemaVersion(db Queryer) (_ int, err error) {
+	defer observe("SchemaVersion", time.Now(), &err)
+	var v int
+	if err = db.Get(&v, `SELECT version FROM schemaversion`); err != nil {
+		return 0, err
+	}
+	return v, nil
+}
@@ -0,0 +1,206 @@
+package dt
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// fakeQueryer is an in-memory Queryer which answers the queries made by
+// GetUser, Ping and SchemaVersion. If err is set, every query fails with it.
+type fakeQueryer struct {
+	users   map[uint64]User
+	flexIDs map[string]uint64
+	err     error
+}
+
+func (f *fakeQueryer) Get(dest interface{}, query string,
+	args ...interface{}) error {
+
+	if f.err != nil {
+		return f.err
+	}
+	switch d := dest.(type) {
+	case *int:
+		*d = 1
+	case *uint64:
+		uid, ok := f.flexIDs[args[0].(string)]
+		if !ok {
+			return sql.ErrNoRows
+		}
+		*d = uid
+	case *User:
+		u, ok := f.users[args[0].(uint64)]
+		if !ok {
+			return sql.ErrNoRows
+		}
+		d.ID, d.Name, d.Email = u.ID, u.Name, u.Email
+	default:
+		return errors.New("fakeQueryer: unsupported Get")
+	}
+	return nil
+}
+
+func (f *fakeQueryer) Select(dest interface{}, query string,
+	args ...interface{}) error {
+	return errors.New("fakeQueryer: unsupported Select")
+}
+
+func (f *fakeQueryer) Exec(query string, args ...interface{}) (sql.Result,
+	error) {
+	return nil, errors.New("fakeQueryer: unsupported Exec")
+}
+
+func (f *fakeQueryer) QueryRowx(query string, args ...interface{}) *sqlx.Row {
+	return nil
+}
+
+func TestGetUserFakeQueryer(t *testing.T) {
+	db := &fakeQueryer{
+		users: map[uint64]User{
+			1: {ID: 1, Name: "Alice", Email: "alice@example.com"},
+		},
+		flexIDs: map[string]uint64{
+			"+13105555555": 1,
+			"+13105555556": 2, // dangling
+		},
+	}
+	u, err := GetUser(db, &Request{UserID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "Alice" {
+		t.Fatal("expected Alice, got", u.Name)
+	}
+	req := &Request{FlexID: "(310) 555-5555", FlexIDType: FIDTPhone}
+	u, err = GetUser(db, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.ID != 1 || u.FlexID != "+13105555555" {
+		t.Fatalf("expected user 1 by phone, got %d %q", u.ID, u.FlexID)
+	}
+	req = &Request{FlexID: "(310) 555-5555"}
+	if u, err = GetUser(db, req); err != nil {
+		t.Fatal(err)
+	}
+	if u.ID != 1 || req.FlexIDType != FIDTPhone {
+		t.Fatalf("expected user 1 by inferred phone, got %d %d", u.ID,
+			req.FlexIDType)
+	}
+	for _, fid := range []string{"+13105555556", "+13105555557"} {
+		req = &Request{FlexID: fid, FlexIDType: FIDTPhone}
+		u, err = GetUser(db, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.ID != 0 || req.UserID != 0 {
+			t.Fatal("expected unregistered user for", fid)
+		}
+	}
+	if _, err = GetUser(db, &Request{UserID: 2}); err != ErrMissingUser {
+		t.Fatal("expected ErrMissingUser, got", err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	if err := Ping(&fakeQueryer{}); err != nil {
+		t.Fatal(err)
+	}
+	errDown := errors.New("connection refused")
+	if err := Ping(&fakeQueryer{err: errDown}); err != errDown {
+		t.Fatal("expected", errDown, "got", err)
+	}
+}
+
+// hungQueryer is a Queryer whose queries block until release is closed,
+// counting the queries started.
+type hungQueryer struct {
+	fakeQueryer
+	release chan struct{}
+	mu      sync.Mutex
+	started int
+}
+
+func (h *hungQueryer) Get(dest interface{}, query string,
+	args ...interface{}) error {
+
+	h.mu.Lock()
+	h.started++
+	h.mu.Unlock()
+	<-h.release
+	return h.fakeQueryer.Get(dest, query, args...)
+}
+
+func TestPingHung(t *testing.T) {
+	db := &hungQueryer{release: make(chan struct{})}
+	for i := 0; i < 3; i++ {
+		if err := ping(db, 10*time.Millisecond); err != ErrPingTimeout {
+			t.Fatal("expected ErrPingTimeout, got", err)
+		}
+	}
+	db.mu.Lock()
+	started := db.started
+	db.mu.Unlock()
+	if started != 1 {
+		t.Fatal("expected pings to share one query, got", started)
+	}
+	close(db.release)
+	if err := ping(db, time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	v, err := SchemaVersion(&fakeQueryer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 1 {
+		t.Fatal("expected version 1, got", v)
+	}
+	errDown := errors.New("connection refused")
+	if _, err = SchemaVersion(&fakeQueryer{err: errDown}); err != errDown {
+		t.Fatal("expected", errDown, "got", err)
+	}
+}
+
+func TestAfterCommit(t *testing.T) {
+	var ran bool
+	afterCommit(&fakeQueryer{}, func() { ran = true })
+	if !ran {
+		t.Fatal("expected hook to run right away outside a transaction")
+	}
+
+	requireDB(t)
+	ran = false
+	err := WithTx(testDB, func(tx *sqlx.Tx) error {
+		afterCommit(tx, func() { ran = true })
+		if ran {
+			t.Fatal("expected hook to wait for commit")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ran {
+		t.Fatal("expected hook to run after commit")
+	}
+	ran = false
+	errRollback := errors.New("rollback")
+	err = WithTx(testDB, func(tx *sqlx.Tx) error {
+		afterCommit(tx, func() { ran = true })
+		return errRollback
+	})
+	if err != errRollback {
+		t.Fatal("expected", errRollback, "got", err)
+	}
+	if ran {
+		t.Fatal("expected hook to be dropped on rollback")
+	}
+}
@@ -0,0 +1,67 @@
+package dt
+
+import (
+	"database/sql/driver"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// readAttempts and readBackoff configure how reads like GetUser retry
+// transient database errors.
+const (
+	readAttempts = 3
+	readBackoff  = 50 * time.Millisecond
+)
+
+// Retry calls fn up to attempts times until it succeeds, sleeping with
+// exponential backoff starting at base between attempts. Only transient errors
+// like dropped connections and serialization failures are retried; any other
+// error, including sql.ErrNoRows, is returned immediately.
+func Retry(fn func() error, attempts int, base time.Duration) error {
+	var err error
+	for i := 0; ; i++ {
+		err = fn()
+		if err == nil || !isTransient(err) || i+1 >= attempts {
+			return err
+		}
+		time.Sleep(base << uint(i))
+	}
+}
+
+// retryRead calls fn, retrying transient errors as Retry does, with
+// readAttempts and readBackoff. Retries are only made when db is a *sqlx.DB.
+// Postgres aborts a transaction on a serialization failure or deadlock, so
+// within one every retry would fail too. For a transaction fn is called once,
+// and the caller must retry the whole transaction.
+func retryRead(db Queryer, fn func() error) error {
+	if _, ok := db.(*sqlx.DB); !ok {
+		return fn()
+	}
+	return Retry(fn, readAttempts, readBackoff)
+}
+
+// isTransient reports whether err is likely to succeed if the operation is
+// retried.
+func isTransient(err error) bool {
+	if err == driver.ErrBadConn || err == io.EOF ||
+		err == io.ErrUnexpectedEOF {
+		return true
+	}
+	switch e := err.(type) {
+	case *pq.Error:
+		code := string(e.Code)
+		// Class 08 is connection exceptions. 40001 and 40P01 are
+		// serialization failures and deadlocks, and 57P01 is the server
+		// shutting down.
+		return strings.HasPrefix(code, "08") || code == "40001" ||
+			code == "40P01" || code == "57P01"
+	case net.Error:
+		return e.Temporary()
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package dt
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+func TestRetry(t *testing.T) {
+	calls := 0
+	err := Retry(func() error {
+		calls++
+		if calls <= 2 {
+			return driver.ErrBadConn
+		}
+		return nil
+	}, 3, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Fatal("expected 3 calls, got", calls)
+	}
+
+	calls = 0
+	err = Retry(func() error {
+		calls++
+		return &pq.Error{Code: "40001"}
+	}, 2, time.Millisecond)
+	if _, ok := err.(*pq.Error); !ok {
+		t.Fatal("expected last error after retries, got", err)
+	}
+	if calls != 2 {
+		t.Fatal("expected 2 calls, got", calls)
+	}
+}
+
+func TestRetryPermanent(t *testing.T) {
+	permanent := []error{
+		sql.ErrNoRows,
+		&pq.Error{Code: "23505"}, // unique_violation
+		errors.New("other"),
+	}
+	for _, perm := range permanent {
+		calls := 0
+		err := Retry(func() error {
+			calls++
+			return perm
+		}, 3, time.Millisecond)
+		if err != perm {
+			t.Fatalf("expected %v, got %v", perm, err)
+		}
+		if calls != 1 {
+			t.Fatalf("%v: expected 1 call, got %d", perm, calls)
+		}
+	}
+}
+
+// txQueryer is a fake transaction whose queries fail with err, counting the
+// calls made.
+type txQueryer struct {
+	fakeQueryer
+	calls int
+}
+
+func (q *txQueryer) Get(dest interface{}, query string,
+	args ...interface{}) error {
+
+	q.calls++
+	return q.err
+}
+
+func TestRetryReadInTx(t *testing.T) {
+	serialization := &pq.Error{Code: "40001"}
+	tx := &txQueryer{fakeQueryer: fakeQueryer{err: serialization}}
+	_, err := GetUser(tx, &Request{UserID: 1})
+	if err == nil || !strings.Contains(err.Error(), serialization.Error()) {
+		t.Fatal("expected serialization failure, got", err)
+	}
+	if tx.calls != 1 {
+		t.Fatal("expected 1 call in a transaction, got", tx.calls)
+	}
+
+	calls := 0
+	err = retryRead((*sqlx.DB)(nil), func() error {
+		calls++
+		return serialization
+	})
+	if err != serialization || calls != readAttempts {
+		t.Fatalf("expected %d calls outside a transaction, got %d %v",
+			readAttempts, calls, err)
+	}
+}
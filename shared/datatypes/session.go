@@ -0,0 +1,114 @@
+package dt
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrInvalidSession is returned when a session token doesn't match any
+// session.
+var ErrInvalidSession = errors.New("invalid session")
+
+// ErrSessionExpired is returned when a session token matches a session which
+// has expired.
+var ErrSessionExpired = errors.New("session expired")
+
+// CreateSession opens a new session for the user valid for the given ttl,
+// returning a cryptographically random token identifying the session.
+func (u *User) CreateSession(db Queryer, ttl time.Duration) (_ string,
+	err error) {
+
+	defer observe("User.CreateSession", time.Now(), &err)
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	q := `INSERT INTO sessions (userid, token, expiresat)
+	      VALUES ($1, $2, CURRENT_TIMESTAMP + $3::INTERVAL)`
+	if _, err := db.Exec(q, u.ID, token, pgInterval(ttl)); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// GetSessionUser returns the user who owns the session identified by token.
+// ErrInvalidSession is returned if the token is unknown, ErrSessionExpired if
+// the session has expired, and ErrUserDisabled if the user has been disabled.
+func GetSessionUser(db Queryer, token string) (_ *User, err error) {
+	defer observe("GetSessionUser", time.Now(), &err)
+	// Sessions created by CreateSession always have an expiry, which
+	// distinguishes them from other tokens held in the sessions table, like
+	// CSRF tokens.
+	var s struct {
+		UserID uint64
+		Valid  bool
+	}
+	q := `SELECT userid, expiresat > CURRENT_TIMESTAMP AS valid
+	      FROM sessions
+	      WHERE token=$1 AND expiresat IS NOT NULL`
+	err = db.Get(&s, q, token)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidSession
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !s.Valid {
+		return nil, ErrSessionExpired
+	}
+	q = `SELECT ` + userColumns + ` FROM users WHERE id=$1`
+	u, err := getUser(db, q, s.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if u.Disabled {
+		return nil, ErrUserDisabled
+	}
+	return u, nil
+}
+
+// PruneExpiredSessions deletes all expired sessions, returning the number
+// removed. It's designed to be run periodically.
+func PruneExpiredSessions(db Queryer) (_ int64, err error) {
+	defer observe("PruneExpiredSessions", time.Now(), &err)
+	q := `DELETE FROM sessions WHERE expiresat <= CURRENT_TIMESTAMP`
+	res, err := db.Exec(q)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// DeleteExpiredSessions deletes the user's expired sessions, leaving any
+// that are still valid.
+func (u *User) DeleteExpiredSessions(db Queryer) (err error) {
+	defer observe("User.DeleteExpiredSessions", time.Now(), &err)
+	q := `DELETE FROM sessions
+	      WHERE userid=$1 AND expiresat <= CURRENT_TIMESTAMP`
+	if _, err := db.Exec(q, u.ID); err != nil {
+		return err
+	}
+	return nil
+}
+
+// secureEqual compares two secrets in constant time, so that the time taken
+// doesn't reveal how much of a guess was correct. Any comparison of a secret
+// like a token or verification code in Go must use it rather than ==.
+// Comparisons done in SQL by looking up the secret, e.g. WHERE token=$1, don't
+// leak a matching prefix in the same way.
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// pgInterval formats a duration as a Postgres interval. Expiry times are
+// calculated by the database against CURRENT_TIMESTAMP to avoid depending on
+// the timezone of the TIMESTAMP columns.
+func pgInterval(d time.Duration) string {
+	return fmt.Sprintf("%d milliseconds", d/time.Millisecond)
+}
@@ -0,0 +1,138 @@
+package dt
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestSession(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	token, err := u.CreateSession(testDB, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(token) != 64 {
+		t.Fatal("expected 64 character token, got", token)
+	}
+	got, err := GetSessionUser(testDB, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != u.ID {
+		t.Fatal("expected user", u.ID, "got", got.ID)
+	}
+	token2, err := u.CreateSession(testDB, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token2 == token {
+		t.Fatal("expected unique tokens")
+	}
+	if _, err = GetSessionUser(testDB, "unknown"); err != ErrInvalidSession {
+		t.Fatal("expected ErrInvalidSession, got", err)
+	}
+}
+
+func TestSessionExpired(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	token, err := u.CreateSession(testDB, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = GetSessionUser(testDB, token); err != ErrSessionExpired {
+		t.Fatal("expected ErrSessionExpired, got", err)
+	}
+}
+
+func TestDeleteSessionsWithTx(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	token, err := u.CreateSession(testDB, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errRollback := errors.New("rollback")
+	err = WithTx(testDB, func(tx *sqlx.Tx) error {
+		if err := u.DeleteSessions(tx); err != nil {
+			return err
+		}
+		if _, err := GetSessionUser(tx, token); err != ErrInvalidSession {
+			t.Fatal("expected session to be deleted in tx, got", err)
+		}
+		return errRollback
+	})
+	if err != errRollback {
+		t.Fatal("expected errRollback, got", err)
+	}
+	if _, err = GetSessionUser(testDB, token); err != nil {
+		t.Fatal("expected session to reappear after rollback, got", err)
+	}
+	if err = u.DeleteSessions(testDB); err != nil {
+		t.Fatal(err)
+	}
+	if err = u.DeleteSessions(testDB); err != nil {
+		t.Fatal("expected deleting no sessions to succeed, got", err)
+	}
+	if _, err = GetSessionUser(testDB, token); err != ErrInvalidSession {
+		t.Fatal("expected ErrInvalidSession, got", err)
+	}
+}
+
+func TestPruneExpiredSessions(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	other := seedUser(t, "u@example.com")
+	var live []string
+	for _, v := range []*User{u, other} {
+		if _, err := v.CreateSession(testDB, -time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		token, err := v.CreateSession(testDB, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		live = append(live, token)
+	}
+
+	// Per-user cleanup leaves other users' expired sessions
+	if err := u.DeleteExpiredSessions(testDB); err != nil {
+		t.Fatal(err)
+	}
+	n, err := PruneExpiredSessions(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatal("expected 1 expired session pruned, got", n)
+	}
+	for _, token := range live {
+		if _, err = GetSessionUser(testDB, token); err != nil {
+			t.Fatal("expected live session to remain, got", err)
+		}
+	}
+}
+
+func TestSecureEqual(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"123456", "123456", true},
+		{"", "", true},
+		{"123456", "123457", false},
+		{"123456", "12345", false},
+		{"123456", "", false},
+		{"abc", "ABC", false},
+	}
+	for _, test := range tests {
+		if got := secureEqual(test.a, test.b); got != test.want {
+			t.Fatalf("secureEqual(%q, %q): expected %t, got %t", test.a,
+				test.b, test.want, got)
+		}
+	}
+}
@@ -2,7 +2,11 @@ package dt
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 
@@ -28,6 +32,18 @@ type User struct {
 	// interface and will be notified via email when new training is
 	// required
 	Trainer bool
+
+	// PaymentServiceID is the user's customer ID on the external payment
+	// service, set by the payment driver on RegisterUser.
+	PaymentServiceID string
+
+	// Disabled users are suspended, e.g. during a fraud review. Their data
+	// is kept, but they can't sign in. See SetDisabled.
+	Disabled bool
+
+	// ContactPreference is the channel through which the user prefers to
+	// be notified. When zero, the user hasn't chosen and is emailed.
+	ContactPreference ContactPreference
 }
 
 // FlexIDType is used to identify a user when only an email, phone, or other
@@ -46,6 +62,25 @@ const (
 	FIDTSession // 3
 )
 
+// FIDTInvalid is the zero FlexIDType, used when a FlexID's type is unknown.
+const FIDTInvalid FlexIDType = 0
+
+// InferFlexIDType guesses the type of a FlexID from its shape, returning
+// FIDTEmail for anything which looks like an email address, including spoken
+// forms like "alice at example dot com", and FIDTPhone for phone numbers.
+// FIDTInvalid is returned when the type can't be inferred. Sessions are opaque
+// tokens, so they're never inferred.
+func InferFlexIDType(s string) FlexIDType {
+	s = strings.TrimSpace(s)
+	if ValidEmail(NormalizeSpokenEmail(s)) {
+		return FIDTEmail
+	}
+	if _, err := NormalizePhone(s); err == nil {
+		return FIDTPhone
+	}
+	return FIDTInvalid
+}
+
 // ErrMissingFlexIDType is returned when a FlexIDType is expected, but
 // none found.
 var ErrMissingFlexIDType = errors.New("missing flexidtype")
@@ -59,53 +94,458 @@ var ErrMissingFlexID = errors.New("missing flexid")
 // (2).
 var ErrInvalidFlexIDType = errors.New("invalid flexid type")
 
-// GetUser from an HTTP request.
-func GetUser(db *sqlx.DB, req *Request) (*User, error) {
+// ErrInvalidFlexID is returned when a FlexID does not match the format
+// expected by its FlexIDType, e.g. an email FlexID without an "@".
+var ErrInvalidFlexID = errors.New("invalid flexid")
+
+// ErrMissingUser is returned when a user is expected but none found.
+var ErrMissingUser = errors.New("missing user")
+
+// ErrInvalidEmail is returned when an email address is malformed.
+var ErrInvalidEmail = errors.New("invalid email")
+
+// ErrUserDisabled is returned when a user is found but has been disabled.
+var ErrUserDisabled = errors.New("user disabled")
+
+// ErrUserExists is returned when creating a user with the same email as an
+// existing user.
+var ErrUserExists = errors.New("user exists")
+
+// FlexIDOrder is the ORDER BY clause deciding which user a flexid resolves to
+// when several users share it. Verified flexids always win, so adding someone
+// else's phone without verifying it can't take over their lookups. Among
+// flexids with the same verification status, the newest wins.
+const FlexIDOrder = `verified DESC, createdat DESC, id DESC`
+
+// GetUser from an HTTP request. If the request identifies the user by FlexID
+// and no registered user has that FlexID, a User holding only the FlexID is
+// returned, since users may talk to Abot before signing up. If the request's
+// FlexIDType is FIDTInvalid, it's inferred from the FlexID with
+// InferFlexIDType. A FlexID shared by several users resolves according to
+// FlexIDOrder. ErrMissingUser is returned if the request's UserID doesn't
+// exist.
+func GetUser(db Queryer, req *Request) (_ *User, err error) {
+	defer observe("GetUser", time.Now(), &err)
 	u := &User{}
 	u.FlexID = req.FlexID
 	u.FlexIDType = req.FlexIDType
-	if req.UserID == 0 {
-		if req.FlexID == "" {
-			return nil, ErrMissingFlexID
-		}
-		switch req.FlexIDType {
-		case FIDTEmail, FIDTPhone, FIDTSession:
-			// Do nothing
-		default:
-			return nil, ErrInvalidFlexIDType
+	byFlexID := req.UserID == 0
+	if byFlexID {
+		if err = normalizeRequest(req); err != nil {
+			return nil, err
 		}
+		u.FlexID, u.FlexIDType = req.FlexID, req.FlexIDType
 		log.Debug("searching for user from", req.FlexID, req.FlexIDType)
 		q := `SELECT userid
 		      FROM userflexids
 		      WHERE flexid=$1 AND flexidtype=$2
-		      ORDER BY createdat DESC`
-		err := db.Get(&req.UserID, q, req.FlexID, req.FlexIDType)
+		      ORDER BY ` + FlexIDOrder
+		err = retryRead(db, func() error {
+			return db.Get(&req.UserID, q, req.FlexID, req.FlexIDType)
+		})
 		if err == sql.ErrNoRows {
 			return u, nil
 		}
 		log.Debug("got uid", req.UserID)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("get user from flexid: %s", err)
 		}
 	}
-	q := `SELECT id, name, email FROM users WHERE id=$1`
-	if err := db.Get(u, q, req.UserID); err != nil {
-		if err == sql.ErrNoRows {
-			return u, nil
+	q := `SELECT ` + userColumns + ` FROM users WHERE id=$1`
+	err = retryRead(db, func() error {
+		return db.Get(u, q, req.UserID)
+	})
+	if err != nil {
+		if err != sql.ErrNoRows {
+			return nil, fmt.Errorf("get user %d: %s", req.UserID, err)
 		}
+		if !byFlexID {
+			return nil, ErrMissingUser
+		}
+		// The FlexID points to a user which has since been deleted, so
+		// treat it as belonging to an unregistered user, same as an
+		// unknown FlexID.
+		log.Debug("flexid belongs to missing user", req.UserID)
+		req.UserID = 0
+		return u, nil
+	}
+	return u, nil
+}
+
+// normalizeRequest prepares a request identifying the user by FlexID for
+// lookup, inferring its FlexIDType if it's FIDTInvalid and normalizing the
+// FlexID in place.
+func normalizeRequest(req *Request) error {
+	if req.FlexID == "" {
+		return ErrMissingFlexID
+	}
+	if req.FlexIDType == FIDTInvalid {
+		req.FlexIDType = InferFlexIDType(req.FlexID)
+	}
+	fid, err := normalizeFlexID(req.FlexID, req.FlexIDType)
+	if err != nil {
+		return err
+	}
+	req.FlexID = fid
+	return nil
+}
+
+// GetActiveUser is the same as GetUser, except that ErrUserDisabled is
+// returned if the user has been disabled.
+func GetActiveUser(db Queryer, req *Request) (*User, error) {
+	u, err := GetUser(db, req)
+	if err != nil {
 		return nil, err
 	}
+	if u.Disabled {
+		return nil, ErrUserDisabled
+	}
 	return u, nil
 }
 
-// Create a new user in the database.
-func (u *User) Create(db *sqlx.DB, fidT FlexIDType, fid string) error {
+// GetUserByFlexID loads the registered user owning the given flexid, along
+// with the matched FlexID itself, so callers can check whether it's Verified
+// without a second query. The flexid is normalized and, if its Type is
+// FIDTInvalid, inferred as in GetUser. A flexid shared by several users
+// resolves according to FlexIDOrder. Unlike GetUser, ErrMissingUser is
+// returned if no registered user owns the flexid.
+func GetUserByFlexID(db Queryer, fid FlexID) (_ *User, _ *FlexID, err error) {
+	defer observe("GetUserByFlexID", time.Now(), &err)
+	if fid.Value == "" {
+		return nil, nil, ErrMissingFlexID
+	}
+	if fid.Type == FIDTInvalid {
+		fid.Type = InferFlexIDType(fid.Value)
+	}
+	v, err := normalizeFlexID(fid.Value, fid.Type)
+	if err != nil {
+		return nil, nil, err
+	}
+	var row struct {
+		User
+		FlexIDVerified  bool
+		FlexIDPrimary   bool
+		FlexIDCreatedAt time.Time
+	}
+	q := `SELECT f.flexid, f.flexidtype, f.verified AS flexidverified,
+		f.isprimary AS flexidprimary, f.createdat AS flexidcreatedat,
+		u.id, u.name, u.email, u.admin, u.trainer, u.paymentserviceid,
+		u.disabled, u.contactpreference
+	      FROM (
+		SELECT flexid, flexidtype, verified, isprimary, createdat,
+			userid
+		FROM userflexids
+		WHERE flexid=$1 AND flexidtype=$2
+		ORDER BY ` + FlexIDOrder + `
+		LIMIT 1
+	      ) f
+	      JOIN users u ON u.id=f.userid`
+	err = retryRead(db, func() error {
+		return db.Get(&row, q, v, fid.Type)
+	})
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrMissingUser
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	matched := &FlexID{
+		Value:     row.FlexID,
+		Type:      row.FlexIDType,
+		Verified:  row.FlexIDVerified,
+		Primary:   row.FlexIDPrimary,
+		CreatedAt: row.FlexIDCreatedAt,
+	}
+	return &row.User, matched, nil
+}
+
+// userColumns are selected when loading a full user record.
+const userColumns = `id, name, email, admin, trainer, paymentserviceid,
+	disabled, contactpreference`
+
+// GetUserByEmail returns the user with the given email, ignoring case.
+// ErrMissingUser is returned if no user has the email.
+func GetUserByEmail(db Queryer, email string) (_ *User, err error) {
+	defer observe("GetUserByEmail", time.Now(), &err)
+	q := `SELECT ` + userColumns + ` FROM users WHERE LOWER(email)=LOWER($1)`
+	return getUser(db, q, strings.TrimSpace(email))
+}
+
+// GetUserByPaymentServiceID returns the user with the given customer ID on the
+// external payment service, which allows payment webhooks to resolve the
+// correct user. ErrMissingUser is returned if no user has the ID.
+func GetUserByPaymentServiceID(db Queryer, id string) (_ *User, err error) {
+	defer observe("GetUserByPaymentServiceID", time.Now(), &err)
+	if id == "" {
+		return nil, ErrMissingUser
+	}
+	q := `SELECT ` + userColumns + ` FROM users WHERE paymentserviceid=$1`
+	return getUser(db, q, id)
+}
+
+// Reload refreshes the user's fields from the database in place, picking up
+// changes made elsewhere, e.g. by a payment webhook. The FlexID, FlexIDType and
+// Password fields aren't stored on the users row and are left as they are.
+// ErrMissingUser is returned if the user no longer exists.
+func (u *User) Reload(db Queryer) (err error) {
+	defer observe("User.Reload", time.Now(), &err)
+	q := `SELECT ` + userColumns + ` FROM users WHERE id=$1`
+	fresh, err := getUser(db, q, u.ID)
+	if err != nil {
+		return err
+	}
+	fresh.FlexID, fresh.FlexIDType = u.FlexID, u.FlexIDType
+	fresh.Password = u.Password
+	*u = *fresh
+	invalidateCachedUser(u.ID)
+	return nil
+}
+
+// GetUsers loads many users in a single query, returning them mapped by ID.
+// IDs that don't belong to any user are absent from the map.
+func GetUsers(db Queryer, ids []uint64) (_ map[uint64]*User, err error) {
+	defer observe("GetUsers", time.Now(), &err)
+	users := map[uint64]*User{}
+	if len(ids) == 0 {
+		return users, nil
+	}
+	q := `SELECT ` + userColumns + ` FROM users WHERE id IN (?)`
+	q, args, err := sqlx.In(q, ids)
+	if err != nil {
+		return nil, err
+	}
+	q = sqlx.Rebind(sqlx.DOLLAR, q)
+	var tmp []User
+	if err = db.Select(&tmp, q, args...); err != nil {
+		return nil, err
+	}
+	for i := range tmp {
+		users[tmp[i].ID] = &tmp[i]
+	}
+	return users, nil
+}
+
+// FlexID pairs a flexible ID with its type, e.g. a phone number with
+// FIDTPhone. Flexids loaded from the database by ListFlexIDs also carry their
+// verification and primary status.
+type FlexID struct {
+	Value     string     `db:"flexid"`
+	Type      FlexIDType `db:"flexidtype"`
+	Verified  bool
+	Primary   bool `db:"isprimary"`
+	CreatedAt time.Time
+}
+
+// GetUsersByFlexIDs resolves many flexids in a single query, returning the
+// registered users mapped by the flexid values as given. Flexids that don't
+// belong to any registered user are absent from the map. As with GetUser, a
+// flexid shared by several users resolves according to FlexIDOrder.
+func GetUsersByFlexIDs(db Queryer, fids []FlexID) (_ map[string]*User,
+	err error) {
+
+	defer observe("GetUsersByFlexIDs", time.Now(), &err)
+	users := map[string]*User{}
+	if len(fids) == 0 {
+		return users, nil
+	}
+	given := map[FlexID]string{}
+	placeholders := make([]string, len(fids))
+	args := make([]interface{}, 0, 2*len(fids))
+	for i, fid := range fids {
+		v, err := normalizeFlexID(fid.Value, fid.Type)
+		if err != nil {
+			return nil, err
+		}
+		given[FlexID{Value: v, Type: fid.Type}] = fid.Value
+		placeholders[i] = fmt.Sprintf("($%d, $%d)", 2*i+1, 2*i+2)
+		args = append(args, v, fid.Type)
+	}
+	q := `SELECT f.flexid, f.flexidtype, u.id, u.name, u.email, u.admin,
+		u.trainer, u.paymentserviceid, u.disabled, u.contactpreference
+	      FROM (
+		SELECT DISTINCT ON (flexid, flexidtype)
+			flexid, flexidtype, userid
+		FROM userflexids
+		WHERE (flexid, flexidtype) IN (` +
+		strings.Join(placeholders, ", ") + `)
+		ORDER BY flexid, flexidtype, ` + FlexIDOrder + `
+	      ) f
+	      JOIN users u ON u.id=f.userid`
+	var tmp []User
+	if err := db.Select(&tmp, q, args...); err != nil {
+		return nil, err
+	}
+	for i := range tmp {
+		fid := FlexID{Value: tmp[i].FlexID, Type: tmp[i].FlexIDType}
+		users[given[fid]] = &tmp[i]
+	}
+	return users, nil
+}
+
+// CountUsers returns the number of registered users.
+func CountUsers(db Queryer) (_ int64, err error) {
+	defer observe("CountUsers", time.Now(), &err)
+	var n int64
+	if err = db.Get(&n, `SELECT COUNT(*) FROM users`); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// CountTrainers returns the number of users with access to the training
+// interface.
+func CountTrainers(db Queryer) (_ int64, err error) {
+	defer observe("CountTrainers", time.Now(), &err)
+	var n int64
+	q := `SELECT COUNT(*) FROM users WHERE trainer=TRUE`
+	if err = db.Get(&n, q); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// ListTrainers returns all users with access to the training interface,
+// ordered by name.
+func ListTrainers(db Queryer) (_ []User, err error) {
+	defer observe("ListTrainers", time.Now(), &err)
+	var users []User
+	q := `SELECT ` + userColumns + ` FROM users
+	      WHERE trainer=TRUE
+	      ORDER BY name, id`
+	if err := db.Select(&users, q); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// SearchUsersByName returns up to limit users whose names begin with prefix,
+// ignoring case, ordered by name. LIKE wildcards in prefix are matched
+// literally. Limits above MaxPageSize are reduced to MaxPageSize.
+func SearchUsersByName(db Queryer, prefix string, limit int) (_ []User,
+	err error) {
+
+	defer observe("SearchUsersByName", time.Now(), &err)
+	if limit < 1 {
+		return nil, ErrInvalidPage
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+	users := []User{}
+	q := `SELECT ` + userColumns + ` FROM users
+	      WHERE name ILIKE $1 ESCAPE '\'
+	      ORDER BY lower(name), id
+	      LIMIT $2`
+	if err := db.Select(&users, q, escapeLike(prefix)+"%", limit); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// likeEscaper escapes the characters with special meaning in a LIKE pattern.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// escapeLike escapes s for literal use in a LIKE pattern with ESCAPE '\'.
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// getUser loads a single user using the provided query, translating
+// sql.ErrNoRows to ErrMissingUser.
+func getUser(db Queryer, q string, args ...interface{}) (*User, error) {
+	u := &User{}
+	err := retryRead(db, func() error {
+		return db.Get(u, q, args...)
+	})
+	if err == sql.ErrNoRows {
+		return nil, ErrMissingUser
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// normalizeFlexID ensures that the FlexID looks like its FlexIDType and
+// converts it into the canonical form stored in the database: lowercase for
+// emails and E.164 for phone numbers. Emails may be given in spoken form, as
+// transcribed by voice channels. See NormalizeSpokenEmail.
+func normalizeFlexID(fid string, fidT FlexIDType) (string, error) {
+	switch fidT {
+	case FIDTEmail:
+		fid = NormalizeSpokenEmail(fid)
+		if !ValidEmail(fid) {
+			return "", ErrInvalidFlexID
+		}
+		return fid, nil
+	case FIDTPhone:
+		phone, err := NormalizePhone(fid)
+		if err != nil {
+			return "", ErrInvalidFlexID
+		}
+		return phone, nil
+	case FIDTSession:
+		// Sessions are opaque tokens, so there's nothing to validate
+		return fid, nil
+	}
+	return "", ErrInvalidFlexIDType
+}
+
+// Create a new user in the database. ErrInvalidEmail is returned if the user's
+// email is malformed, ErrDisposableEmail if it belongs to a disposable email
+// provider, and ErrUserExists if another user has the same email.
+//
+// Signup has no step confirming the user's email or phone, so both flexids are
+// saved as verified, like those added before verification existed. GetPhone
+// returns the phone right away. Flexids added later through AddFlexID remain
+// unverified until confirmed, e.g. by StartPhoneVerification.
+//
+// When db is a *sqlx.DB, the user and their flexids are inserted in a
+// transaction of their own. Passing a *sqlx.Tx instead makes the user part of
+// the caller's transaction, e.g. to add further flexids atomically:
+//
+//	err := WithTx(db, func(tx *sqlx.Tx) error {
+//		if err := u.Create(tx, FIDTPhone, phone); err != nil {
+//			return err
+//		}
+//		return u.AddFlexID(tx, fid, FIDTSession)
+//	})
+//
+// In that case u.ID is set even if the caller later rolls back.
+func (u *User) Create(db Queryer, fidT FlexIDType, fid string) (err error) {
+	defer observe("User.Create", time.Now(), &err)
+	if !ValidEmail(u.Email) {
+		return ErrInvalidEmail
+	}
+	if IsDisposableEmail(u.Email) {
+		return ErrDisposableEmail
+	}
+	if d, ok := db.(*sqlx.DB); ok {
+		err = WithTx(d, func(tx *sqlx.Tx) error {
+			return u.create(tx, fidT, fid)
+		})
+		if err != nil {
+			u.ID = 0
+		}
+		return err
+	}
+	return u.create(db, fidT, fid)
+}
+
+// create inserts the user and their flexids using db, which may be a
+// transaction.
+func (u *User) create(db Queryer, fidT FlexIDType, fid string) error {
 	// Create the password hash
 	hpw, err := bcrypt.GenerateFromPassword([]byte(u.Password), 10)
 	if err != nil {
 		return err
 	}
-	tx, err := db.Beginx()
+	if fidT == FIDTPhone {
+		if fid, err = NormalizePhone(fid); err != nil {
+			return err
+		}
+	}
+	email, err := normalizeFlexID(u.Email, FIDTEmail)
 	if err != nil {
 		return err
 	}
@@ -113,42 +553,615 @@ func (u *User) Create(db *sqlx.DB, fidT FlexIDType, fid string) error {
 	      VALUES ($1, $2, $3, 0, $4)
 	      RETURNING id`
 	var uid uint64
-	err = tx.QueryRowx(q, u.Name, u.Email, hpw, u.Admin).Scan(&uid)
-	if err != nil && err.Error() ==
-		`pq: duplicate key value violates unique constraint "users_email_key"` {
-		_ = tx.Rollback()
-		return err
+	err = db.QueryRowx(q, u.Name, u.Email, hpw, u.Admin).Scan(&uid)
+	if isDuplicateEmail(err) {
+		return ErrUserExists
 	}
 	if uid == 0 {
-		_ = tx.Rollback()
 		return err
 	}
-	q = `INSERT INTO userflexids (userid, flexid, flexidtype)
-	     VALUES ($1, $2, $3)`
-	_, err = tx.Exec(q, uid, u.Email, 1)
+	q = `INSERT INTO userflexids (userid, flexid, flexidtype, verified)
+	     VALUES ($1, $2, $3, TRUE)`
+	_, err = db.Exec(q, uid, email, 1)
 	if err != nil {
+		return err
+	}
+	_, err = db.Exec(q, uid, fid, 2)
+	if err != nil {
+		return err
+	}
+	u.ID = uid
+	return nil
+}
+
+// Update saves changes to the user's name, email and payment service ID.
+// ErrInvalidEmail is returned if the email is malformed, ErrDisposableEmail if
+// it belongs to a disposable email provider, ErrMissingUser if the user
+// doesn't exist, and ErrUserExists if another user has the same email.
+func (u *User) Update(db Queryer) (err error) {
+	defer observe("User.Update", time.Now(), &err)
+	if !ValidEmail(u.Email) {
+		return ErrInvalidEmail
+	}
+	if IsDisposableEmail(u.Email) {
+		return ErrDisposableEmail
+	}
+	q := `UPDATE users SET name=$1, email=$2, paymentserviceid=$3,
+		updatedat=CURRENT_TIMESTAMP
+	      WHERE id=$4`
+	res, err := db.Exec(q, u.Name, u.Email, u.PaymentServiceID, u.ID)
+	if isDuplicateEmail(err) {
+		return ErrUserExists
+	}
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrMissingUser
+	}
+	invalidateCachedUser(u.ID)
+	return nil
+}
+
+// ChangeEmail updates the user's email along with their email flexid, which is
+// marked unverified until the user confirms the new address. Both changes are
+// made in a single transaction. ErrInvalidEmail is returned if the new email
+// is malformed, ErrDisposableEmail if it belongs to a disposable email
+// provider, and ErrUserExists if another user has it.
+func (u *User) ChangeEmail(db *sqlx.DB, newEmail string) (err error) {
+	defer observe("User.ChangeEmail", time.Now(), &err)
+	newEmail = strings.TrimSpace(newEmail)
+	if !ValidEmail(newEmail) {
+		return ErrInvalidEmail
+	}
+	if IsDisposableEmail(newEmail) {
+		return ErrDisposableEmail
+	}
+	err = WithTx(db, func(tx *sqlx.Tx) error {
+		var count int
+		q := `SELECT COUNT(*) FROM users
+		      WHERE LOWER(email)=LOWER($1) AND id<>$2`
+		if err := tx.Get(&count, q, newEmail, u.ID); err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrUserExists
+		}
+		q = `UPDATE users SET email=$1, updatedat=CURRENT_TIMESTAMP
+		     WHERE id=$2`
+		res, err := tx.Exec(q, newEmail, u.ID)
+		if isDuplicateEmail(err) {
+			return ErrUserExists
+		}
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrMissingUser
+		}
+		q = `DELETE FROM userflexids
+		     WHERE userid=$1 AND flexidtype=$2
+		       AND LOWER(flexid) IN (LOWER($3), LOWER($4))`
+		_, err = tx.Exec(q, u.ID, FIDTEmail, u.Email, newEmail)
+		if err != nil {
+			return fmt.Errorf("delete email flexid: %s", err)
+		}
+		q = `INSERT INTO userflexids
+			(userid, flexid, flexidtype, createdat, verified)
+		     VALUES ($1, $2, $3, $4, FALSE)`
+		_, err = tx.Exec(q, u.ID, strings.ToLower(newEmail), FIDTEmail,
+			time.Now())
+		if err != nil {
+			return fmt.Errorf("insert email flexid: %s", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	u.Email = newEmail
+	invalidateCachedUser(u.ID)
+	invalidateCachedFlexID(strings.ToLower(newEmail), FIDTEmail)
+	return nil
+}
+
+// userTables lists every table holding data belonging to a user by its userid
+// column. The users row itself is deleted last.
+var userTables = []string{
+	"cards",
+	"sessions",
+	"userflexids",
+	"preferences",
+	"userprefs",
+	"states",
+	"contacts",
+	"passwordresets",
+	"messages",
+	"phoneverifications",
+	"idempotencykeys",
+}
+
+// Delete the user and all of their data in a single transaction. If a step
+// fails, the returned error identifies the table involved. The user's customer
+// record on the external payment service is not removed, so callers should
+// remove it through their payment driver first if needed.
+func (u *User) Delete(db *sqlx.DB) (err error) {
+	defer observe("User.Delete", time.Now(), &err)
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	if err = deleteUserData(tx, u.ID); err != nil {
 		_ = tx.Rollback()
 		return err
 	}
-	_, err = tx.Exec(q, uid, fid, 2)
+	res, err := tx.Exec(`DELETE FROM users WHERE id=$1`, u.ID)
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("delete user %d from users: %s", u.ID, err)
+	}
+	n, err := res.RowsAffected()
 	if err != nil {
 		_ = tx.Rollback()
 		return err
 	}
+	if n == 0 {
+		_ = tx.Rollback()
+		return ErrMissingUser
+	}
 	if err = tx.Commit(); err != nil {
 		return err
 	}
-	u.ID = uid
+	invalidateCachedUser(u.ID)
+	return nil
+}
+
+// deleteUserData deletes the user's rows from every table in userTables. The
+// returned error identifies the table involved.
+func deleteUserData(tx Queryer, uid uint64) error {
+	for _, table := range userTables {
+		q := `DELETE FROM ` + table + ` WHERE userid=$1`
+		if _, err := tx.Exec(q, uid); err != nil {
+			return fmt.Errorf("delete user %d from %s: %s", uid, table,
+				err)
+		}
+	}
+	return nil
+}
+
+// Anonymize scrubs the user's personal information while keeping their users
+// row and ID, e.g. to satisfy a retention policy which doesn't allow deletion.
+// As with Delete, all of the user's data in other tables is deleted, and
+// their customer record on the payment service is left for the caller to
+// remove. The user's name, email, password and payment service ID are replaced
+// with placeholders, and the user is disabled so they can't log in. Their
+// AuditLog is kept.
+func (u *User) Anonymize(db *sqlx.DB) (err error) {
+	defer observe("User.Anonymize", time.Now(), &err)
+	email := fmt.Sprintf("user%d@anonymized.invalid", u.ID)
+	err = WithTx(db, func(tx *sqlx.Tx) error {
+		if err := deleteUserData(tx, u.ID); err != nil {
+			return err
+		}
+		q := `UPDATE users
+		      SET name='Anonymous', email=$1, password='',
+			paymentserviceid='', disabled=TRUE,
+			updatedat=CURRENT_TIMESTAMP
+		      WHERE id=$2`
+		res, err := tx.Exec(q, email, u.ID)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrMissingUser
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	*u = User{
+		ID:       u.ID,
+		Name:     "Anonymous",
+		Email:    email,
+		Admin:    u.Admin,
+		Trainer:  u.Trainer,
+		Disabled: true,
+	}
+	invalidateCachedUser(u.ID)
+	return nil
+}
+
+// ErrMergeSelf is returned when attempting to merge a user into itself.
+var ErrMergeSelf = errors.New("can't merge a user into itself")
+
+// mergedTables lists the tables whose rows are reassigned to the kept user by
+// MergeUsers. Rows in the remaining userTables are deleted with the merged
+// user.
+var mergedTables = []string{
+	"cards",
+	"userflexids",
+	"sessions",
+	"messages",
+}
+
+// MergeUsers moves the cards, flexids, sessions and messages of the user
+// mergeID to the user keepID, then deletes mergeID, all in a single
+// transaction. This repairs duplicate accounts created for the same person.
+// Where both users have the same flexid or session label, the kept user's row
+// wins, and the kept user's primary flexids remain primary. ErrMissingUser is
+// returned if either user doesn't exist.
+func MergeUsers(db *sqlx.DB, keepID, mergeID uint64) (err error) {
+	defer observe("MergeUsers", time.Now(), &err)
+	if keepID == mergeID {
+		return ErrMergeSelf
+	}
+	err = WithTx(db, func(tx *sqlx.Tx) error {
+		var count int
+		q := `SELECT COUNT(*) FROM users WHERE id IN ($1, $2)`
+		if err := tx.Get(&count, q, keepID, mergeID); err != nil {
+			return err
+		}
+		if count != 2 {
+			return ErrMissingUser
+		}
+		q = `DELETE FROM userflexids
+		     WHERE userid=$2 AND flexid IN (
+			SELECT flexid FROM userflexids WHERE userid=$1
+		     )`
+		if _, err := tx.Exec(q, keepID, mergeID); err != nil {
+			return fmt.Errorf("delete duplicate flexids: %s", err)
+		}
+		q = `UPDATE userflexids SET isprimary=FALSE
+		     WHERE userid=$2 AND flexidtype IN (
+			SELECT flexidtype FROM userflexids
+			WHERE userid=$1 AND isprimary=TRUE
+		     )`
+		if _, err := tx.Exec(q, keepID, mergeID); err != nil {
+			return fmt.Errorf("unset primary flexids: %s", err)
+		}
+		q = `DELETE FROM sessions
+		     WHERE userid=$2 AND label IN (
+			SELECT label FROM sessions WHERE userid=$1
+		     )`
+		if _, err := tx.Exec(q, keepID, mergeID); err != nil {
+			return fmt.Errorf("delete duplicate sessions: %s", err)
+		}
+		for _, table := range mergedTables {
+			q = `UPDATE ` + table + ` SET userid=$1 WHERE userid=$2`
+			if _, err := tx.Exec(q, keepID, mergeID); err != nil {
+				return fmt.Errorf("merge user %d into %d in %s: %s",
+					mergeID, keepID, table, err)
+			}
+		}
+		if err := deleteUserData(tx, mergeID); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`DELETE FROM users WHERE id=$1`, mergeID)
+		if err != nil {
+			return fmt.Errorf("delete user %d from users: %s", mergeID,
+				err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	invalidateCachedUser(mergeID)
+	return nil
+}
+
+// SetTrainer grants or revokes the user's access to the training interface.
+func (u *User) SetTrainer(db Queryer, trainer bool) (err error) {
+	defer observe("User.SetTrainer", time.Now(), &err)
+	q := `UPDATE users SET trainer=$1, updatedat=CURRENT_TIMESTAMP
+	      WHERE id=$2`
+	res, err := db.Exec(q, trainer, u.ID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrMissingUser
+	}
+	u.Trainer = trainer
+	invalidateCachedUser(u.ID)
+	return nil
+}
+
+// SetDisabled suspends or restores the user's account without deleting any of
+// their data. Disabled users can't sign in; see GetActiveUser.
+func (u *User) SetDisabled(db Queryer, disabled bool) (err error) {
+	defer observe("User.SetDisabled", time.Now(), &err)
+	q := `UPDATE users SET disabled=$1, updatedat=CURRENT_TIMESTAMP
+	      WHERE id=$2`
+	res, err := db.Exec(q, disabled, u.ID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrMissingUser
+	}
+	u.Disabled = disabled
+	invalidateCachedUser(u.ID)
+	return nil
+}
+
+// SetPaymentServiceID saves the user's customer ID on the external payment
+// service, e.g. after registering them through a payment driver.
+func (u *User) SetPaymentServiceID(db Queryer, id string) (err error) {
+	defer observe("User.SetPaymentServiceID", time.Now(), &err)
+	q := `UPDATE users SET paymentserviceid=$1, updatedat=CURRENT_TIMESTAMP
+	      WHERE id=$2`
+	res, err := db.Exec(q, id, u.ID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrMissingUser
+	}
+	u.PaymentServiceID = id
+	invalidateCachedUser(u.ID)
+	return nil
+}
+
+// isDuplicateEmail reports whether err is a violation of the unique constraint
+// on users.email.
+func isDuplicateEmail(err error) bool {
+	return err != nil && err.Error() ==
+		`pq: duplicate key value violates unique constraint "users_email_key"`
+}
+
+// AddFlexID associates a new email, phone or session FlexID with the user.
+// Emails are lowercased and phone numbers are converted to E.164 before
+// saving. Adding a FlexID the user already has is a no-op. When db is a
+// transaction begun by WithTx, cached copies of the user are evicted once it
+// commits.
+func (u *User) AddFlexID(db Queryer, fid string, fidT FlexIDType) (err error) {
+	defer observe("User.AddFlexID", time.Now(), &err)
+	fid = strings.TrimSpace(fid)
+	if fid == "" {
+		return ErrMissingFlexID
+	}
+	fid, err = normalizeFlexID(fid, fidT)
+	if err != nil {
+		return err
+	}
+	q := `INSERT INTO userflexids (userid, flexid, flexidtype, createdat)
+	      VALUES ($1, $2, $3, $4)
+	      ON CONFLICT (userid, flexid, flexidtype) DO NOTHING`
+	res, err := db.Exec(q, u.ID, fid, fidT, time.Now())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return nil
+	}
+	afterCommit(db, func() {
+		invalidateCachedUser(u.ID)
+		invalidateCachedFlexID(fid, fidT)
+	})
+	return nil
+}
+
+// GetPhone returns the user's primary verified phone number in E.164 format,
+// falling back to the most recently added verified phone number if none is
+// primary. ErrMissingFlexID is returned if the user has no verified
+// phone number. See StartPhoneVerification.
+func (u *User) GetPhone(db Queryer) (_ string, err error) {
+	defer observe("User.GetPhone", time.Now(), &err)
+	var phone string
+	q := `SELECT flexid FROM userflexids
+	      WHERE userid=$1 AND flexidtype=$2 AND verified=TRUE
+	      ORDER BY isprimary DESC, createdat DESC, id DESC LIMIT 1`
+	err = db.Get(&phone, q, u.ID, FIDTPhone)
+	if err == sql.ErrNoRows {
+		return "", ErrMissingFlexID
+	}
+	if err != nil {
+		return "", err
+	}
+	return NormalizePhone(phone)
+}
+
+// Emails returns all of the user's email addresses. The first is always the
+// user's Email, which is the address they log in with and the one returned by
+// GetEmail. It's followed by any other verified email flexids, with the
+// primary first and the rest newest first. Unverified emails are excluded, so
+// that notifications aren't sent to addresses the user hasn't confirmed.
+func (u *User) Emails(db Queryer) (_ []string, err error) {
+	defer observe("User.Emails", time.Now(), &err)
+	var email string
+	q := `SELECT email FROM users WHERE id=$1`
+	err = db.Get(&email, q, u.ID)
+	if err == sql.ErrNoRows {
+		return nil, ErrMissingUser
+	}
+	if err != nil {
+		return nil, err
+	}
+	var others []string
+	q = `SELECT flexid FROM userflexids
+	     WHERE userid=$1 AND flexidtype=$2 AND verified=TRUE
+	       AND LOWER(flexid)<>LOWER($3)
+	     ORDER BY isprimary DESC, createdat DESC, id DESC`
+	if err = db.Select(&others, q, u.ID, FIDTEmail, email); err != nil {
+		return nil, err
+	}
+	return append([]string{email}, others...), nil
+}
+
+// ListFlexIDs returns all of the user's flexids grouped by type. Within each
+// type the primary flexid comes first, followed by the others newest first.
+func (u *User) ListFlexIDs(db Queryer) (_ []FlexID, err error) {
+	defer observe("User.ListFlexIDs", time.Now(), &err)
+	fids := []FlexID{}
+	q := `SELECT flexid, flexidtype, verified, isprimary, createdat
+	      FROM userflexids WHERE userid=$1
+	      ORDER BY flexidtype, isprimary DESC, createdat DESC, id DESC`
+	if err := db.Select(&fids, q, u.ID); err != nil {
+		return nil, err
+	}
+	return fids, nil
+}
+
+// SetPrimaryFlexID marks one of the user's flexids as the primary for its
+// type, replacing any previous primary. ErrMissingFlexID is returned if the
+// user doesn't have the flexid.
+func (u *User) SetPrimaryFlexID(db *sqlx.DB, fid string, fidT FlexIDType) (
+	err error) {
+
+	defer observe("User.SetPrimaryFlexID", time.Now(), &err)
+	fid, err = normalizeFlexID(strings.TrimSpace(fid), fidT)
+	if err != nil {
+		return err
+	}
+	err = WithTx(db, func(tx *sqlx.Tx) error {
+		q := `UPDATE userflexids SET isprimary=FALSE
+		      WHERE userid=$1 AND flexidtype=$2 AND isprimary=TRUE`
+		if _, err := tx.Exec(q, u.ID, fidT); err != nil {
+			return err
+		}
+		q = `UPDATE userflexids SET isprimary=TRUE
+		     WHERE userid=$1 AND flexid=$2 AND flexidtype=$3`
+		res, err := tx.Exec(q, u.ID, fid, fidT)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrMissingFlexID
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	invalidateCachedUser(u.ID)
 	return nil
 }
 
 // DeleteSessions removes any open sessions by the user. This enables "logging
-// out" of the web-based client.
-func (u *User) DeleteSessions(db *sqlx.DB) error {
+// out" of the web-based client. Pass a *sqlx.Tx to log out as part of a larger
+// transaction.
+func (u *User) DeleteSessions(db Queryer) (err error) {
+	defer observe("User.DeleteSessions", time.Now(), &err)
 	q := `DELETE FROM sessions WHERE userid=$1`
-	_, err := db.Exec(q, u.ID)
+	_, err = db.Exec(q, u.ID)
 	if err != nil && err != sql.ErrNoRows {
 		return err
 	}
 	return nil
 }
+
+// String describes the user without any personal information, e.g.
+// "User#12 Alice", so users and pointers to them can be logged safely.
+func (u User) String() string {
+	return fmt.Sprintf("User#%d %s", u.ID, u.Name)
+}
+
+// userJSON is the JSON encoding of a User. Password is never encoded.
+type userJSON struct {
+	ID                uint64
+	Name              string
+	Email             string
+	Admin             bool
+	FlexID            string `json:",omitempty"`
+	FlexIDType        FlexIDType
+	Trainer           bool
+	PaymentServiceID  string `json:",omitempty"`
+	Disabled          bool
+	ContactPreference ContactPreference
+}
+
+// MarshalJSON encodes the user with their email and FlexID masked and without
+// their payment service ID, so users can be included in logs and API responses
+// without leaking personal information. Use MarshalJSONFull when the
+// unredacted fields are required.
+func (u User) MarshalJSON() ([]byte, error) {
+	return json.Marshal(userJSON{
+		ID:                u.ID,
+		Name:              u.Name,
+		Email:             maskEmail(u.Email),
+		Admin:             u.Admin,
+		FlexID:            maskFlexID(u.FlexID, u.FlexIDType),
+		FlexIDType:        u.FlexIDType,
+		Trainer:           u.Trainer,
+		Disabled:          u.Disabled,
+		ContactPreference: u.ContactPreference,
+	})
+}
+
+// MarshalJSONFull encodes the user including their email, FlexID and payment
+// service ID. The password is still omitted.
+func (u *User) MarshalJSONFull() ([]byte, error) {
+	return json.Marshal(userJSON{
+		ID:                u.ID,
+		Name:              u.Name,
+		Email:             u.Email,
+		Admin:             u.Admin,
+		FlexID:            u.FlexID,
+		FlexIDType:        u.FlexIDType,
+		Trainer:           u.Trainer,
+		PaymentServiceID:  u.PaymentServiceID,
+		Disabled:          u.Disabled,
+		ContactPreference: u.ContactPreference,
+	})
+}
+
+// maskEmail hides all but the first character of an email's local part, e.g.
+// "j***@example.com".
+func maskEmail(email string) string {
+	i := strings.Index(email, "@")
+	if i < 1 {
+		if email == "" {
+			return ""
+		}
+		return "***"
+	}
+	return email[:1] + "***" + email[i:]
+}
+
+// maskFlexID hides a FlexID according to its type. Phones keep their last four
+// digits, and session tokens are removed entirely.
+func maskFlexID(fid string, fidT FlexIDType) string {
+	switch {
+	case fid == "":
+		return ""
+	case fidT == FIDTEmail:
+		return maskEmail(fid)
+	case fidT == FIDTPhone && len(fid) > 4:
+		return "***" + fid[len(fid)-4:]
+	}
+	return ""
+}
@@ -0,0 +1,1365 @@
+package dt
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/itsabot/abot/core/log"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+)
+
+// testDB is connected to ABOT_DATABASE_URL when it's available and ABOT_ENV ==
+// "test". Tests that need the database call requireDB, so the remaining tests
+// still run without one. requireDB deletes every user, so the database is
+// never touched outside of the test environment.
+var testDB *sqlx.DB
+
+func TestMain(m *testing.M) {
+	u := os.Getenv("ABOT_DATABASE_URL")
+	switch {
+	case u == "":
+	case os.Getenv("ABOT_ENV") != "test":
+		log.Info(`ABOT_ENV != "test", skipping db tests.`)
+	default:
+		var err error
+		testDB, err = sqlx.Connect("postgres", u)
+		if err != nil {
+			log.Info("failed to connect to db, skipping db tests.", err)
+		}
+	}
+	os.Exit(m.Run())
+}
+
+// requireDB skips the test if no database is available, otherwise clearing out
+// any data left by previous tests.
+func requireDB(t testing.TB) {
+	if testDB == nil {
+		t.Skip(`ABOT_DATABASE_URL not set or ABOT_ENV != "test"`)
+	}
+	for _, table := range append(userTables, "auditlog", "users") {
+		if _, err := testDB.Exec(`DELETE FROM ` + table); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// seedUser inserts a user with the given email into the database.
+func seedUser(t testing.TB, email string) *User {
+	u := &User{Name: "t", Email: email}
+	q := `INSERT INTO users (name, email, password, locationid)
+	      VALUES ($1, $2, 'password', 0)
+	      RETURNING id`
+	if err := testDB.QueryRowx(q, u.Name, u.Email).Scan(&u.ID); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestGetUserValidatesFlexID(t *testing.T) {
+	// None of these requests should reach the database, so a nil DB is
+	// safe to pass.
+	tests := map[string]struct {
+		req *Request
+		err error
+	}{
+		"missing flexid": {
+			req: &Request{FlexIDType: FIDTEmail},
+			err: ErrMissingFlexID,
+		},
+		"invalid type": {
+			req: &Request{FlexID: "t@example.com", FlexIDType: 9},
+			err: ErrInvalidFlexIDType,
+		},
+		"uninferrable type": {
+			req: &Request{FlexID: "garbage"},
+			err: ErrInvalidFlexIDType,
+		},
+		"email not an email": {
+			req: &Request{FlexID: "+13105555555", FlexIDType: FIDTEmail},
+			err: ErrInvalidFlexID,
+		},
+		"phone not a phone": {
+			req: &Request{FlexID: "t@example.com", FlexIDType: FIDTPhone},
+			err: ErrInvalidFlexID,
+		},
+	}
+	for name, test := range tests {
+		if _, err := GetUser(nil, test.req); err != test.err {
+			t.Fatalf("%s: expected %v, got %v", name, test.err, err)
+		}
+	}
+}
+
+func TestInferFlexIDType(t *testing.T) {
+	tests := map[string]FlexIDType{
+		"t@example.com":         FIDTEmail,
+		" T.U@Mail.Example.org": FIDTEmail,
+		"t at example dot com":  FIDTEmail,
+		"+13105555555":          FIDTPhone,
+		"(310) 555-5555":        FIDTPhone,
+		"310.555.5555":          FIDTPhone,
+		"+44 20 7946 0958":      FIDTPhone,
+		"":                      FIDTInvalid,
+		"garbage":               FIDTInvalid,
+		"555-5555":              FIDTInvalid,
+		"t@example":             FIDTInvalid,
+		"John <t@example.com>":  FIDTInvalid,
+		"3f2a9c0e1b":            FIDTInvalid,
+	}
+	for fid, want := range tests {
+		if got := InferFlexIDType(fid); got != want {
+			t.Fatalf("%q: expected %d, got %d", fid, want, got)
+		}
+	}
+}
+
+func TestNormalizeFlexID(t *testing.T) {
+	tests := []struct {
+		fid  string
+		fidT FlexIDType
+		want string
+	}{
+		{"t@example.com", FIDTEmail, "t@example.com"},
+		{"T.U@Mail.Example.org", FIDTEmail, "t.u@mail.example.org"},
+		{"t at example dot com.", FIDTEmail, "t@example.com"},
+		{"+13105555555", FIDTPhone, "+13105555555"},
+		{"(310) 555-5555", FIDTPhone, "+13105555555"},
+		{"anything", FIDTSession, "anything"},
+	}
+	for _, test := range tests {
+		got, err := normalizeFlexID(test.fid, test.fidT)
+		if err != nil {
+			t.Fatalf("expected %q (%d) to be valid, got %s", test.fid,
+				test.fidT, err)
+		}
+		if got != test.want {
+			t.Fatalf("expected %q, got %q", test.want, got)
+		}
+	}
+}
+
+func TestAddFlexIDValidation(t *testing.T) {
+	// Validation happens before the database is used, so a nil DB is safe
+	// to pass.
+	u := &User{ID: 1}
+	tests := map[string]struct {
+		fid  string
+		fidT FlexIDType
+		err  error
+	}{
+		"empty":        {"", FIDTPhone, ErrMissingFlexID},
+		"whitespace":   {"  ", FIDTEmail, ErrMissingFlexID},
+		"invalid type": {"+13105555555", FlexIDType(0), ErrInvalidFlexIDType},
+		"unknown type": {"+13105555555", FlexIDType(9), ErrInvalidFlexIDType},
+		"bad email":    {"t.example.com", FIDTEmail, ErrInvalidFlexID},
+		"bad phone":    {"555-5555", FIDTPhone, ErrInvalidFlexID},
+	}
+	for name, test := range tests {
+		if err := u.AddFlexID(nil, test.fid, test.fidT); err != test.err {
+			t.Fatalf("%s: expected %v, got %v", name, test.err, err)
+		}
+	}
+}
+
+func TestAddFlexIDConcurrent(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- u.AddFlexID(testDB, "+13105555555", FIDTPhone)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var count int
+	q := `SELECT COUNT(*) FROM userflexids WHERE userid=$1`
+	if err := testDB.Get(&count, q, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatal("expected 1 flexid, got", count)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	u := &User{Name: "t", Email: "t.example.com", Password: "password"}
+	if err := u.Create(nil, FIDTPhone, "+13105555555"); err != ErrInvalidEmail {
+		t.Fatal("expected ErrInvalidEmail, got", err)
+	}
+
+	requireDB(t)
+	u.Email = "T@Example.com"
+	if err := u.Create(testDB, FIDTPhone, "(310) 555-5555"); err != nil {
+		t.Fatal(err)
+	}
+	if u.ID == 0 {
+		t.Fatal("expected user ID to be set")
+	}
+	var fid string
+	q := `SELECT flexid FROM userflexids WHERE userid=$1 AND flexidtype=2`
+	if err := testDB.Get(&fid, q, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if fid != "+13105555555" {
+		t.Fatal("expected normalized phone flexid, got", fid)
+	}
+	phone, err := u.GetPhone(testDB)
+	if err != nil {
+		t.Fatal("expected signup phone to be verified, got", err)
+	}
+	if phone != "+13105555555" {
+		t.Fatal("expected +13105555555, got", phone)
+	}
+	found, err := GetUser(testDB, &Request{
+		FlexID:     "T@Example.com",
+		FlexIDType: FIDTEmail,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.ID != u.ID {
+		t.Fatalf("expected user %d by email, got %d", u.ID, found.ID)
+	}
+	u2 := &User{Name: "u", Email: "t@example.com", Password: "password"}
+	if err := u2.Create(testDB, FIDTPhone, "+13105555556"); err != ErrUserExists {
+		t.Fatal("expected ErrUserExists, got", err)
+	}
+}
+
+func TestCreateWithTx(t *testing.T) {
+	requireDB(t)
+	u := &User{Name: "t", Email: "t@example.com", Password: "password"}
+	err := WithTx(testDB, func(tx *sqlx.Tx) error {
+		if err := u.Create(tx, FIDTPhone, "+13105555555"); err != nil {
+			return err
+		}
+		return u.AddFlexID(tx, "t@example", FIDTEmail)
+	})
+	if err != ErrInvalidFlexID {
+		t.Fatal("expected ErrInvalidFlexID, got", err)
+	}
+	if _, err = GetUserByEmail(testDB, u.Email); err != ErrMissingUser {
+		t.Fatal("expected user creation to be rolled back, got", err)
+	}
+
+	err = WithTx(testDB, func(tx *sqlx.Tx) error {
+		if err := u.Create(tx, FIDTPhone, "+13105555555"); err != nil {
+			return err
+		}
+		return u.AddFlexID(tx, "t2@example.com", FIDTEmail)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	q := `SELECT COUNT(*) FROM userflexids WHERE userid=$1`
+	if err = testDB.Get(&count, q, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Fatal("expected 3 flexids, got", count)
+	}
+}
+
+func TestGetUserByEmail(t *testing.T) {
+	requireDB(t)
+	seed := seedUser(t, "T@example.com")
+	for _, email := range []string{"T@example.com", "t@EXAMPLE.com"} {
+		u, err := GetUserByEmail(testDB, email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.ID != seed.ID {
+			t.Fatal("expected user", seed.ID, "got", u.ID)
+		}
+	}
+	if _, err := GetUserByEmail(testDB, "u@example.com"); err != ErrMissingUser {
+		t.Fatal("expected ErrMissingUser, got", err)
+	}
+}
+
+func TestGetUserByPaymentServiceID(t *testing.T) {
+	requireDB(t)
+	seed := seedUser(t, "t@example.com")
+	q := `UPDATE users SET paymentserviceid='cus_1' WHERE id=$1`
+	if _, err := testDB.Exec(q, seed.ID); err != nil {
+		t.Fatal(err)
+	}
+	u, err := GetUserByPaymentServiceID(testDB, "cus_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.ID != seed.ID || u.PaymentServiceID != "cus_1" {
+		t.Fatal("expected user", seed.ID, "with cus_1, got", u.ID,
+			u.PaymentServiceID)
+	}
+	for _, id := range []string{"cus_2", ""} {
+		_, err = GetUserByPaymentServiceID(testDB, id)
+		if err != ErrMissingUser {
+			t.Fatalf("%q: expected ErrMissingUser, got %v", id, err)
+		}
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	u := &User{ID: 1, Name: "t", Email: "t.example.com"}
+	if err := u.Update(nil); err != ErrInvalidEmail {
+		t.Fatal("expected ErrInvalidEmail, got", err)
+	}
+
+	requireDB(t)
+	u = seedUser(t, "t@example.com")
+	seedUser(t, "u@example.com")
+	u.Name = "Tim"
+	u.Email = "tim@example.com"
+	u.PaymentServiceID = "cus_1"
+	if err := u.Update(testDB); err != nil {
+		t.Fatal(err)
+	}
+	got, err := GetUser(testDB, &Request{UserID: u.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != u.Name || got.Email != u.Email {
+		t.Fatal("expected updated user, got", got.Name, got.Email)
+	}
+	got, err = GetUserByPaymentServiceID(testDB, "cus_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != u.ID {
+		t.Fatal("expected payment service ID to be saved")
+	}
+
+	u.Email = "u@example.com"
+	if err = u.Update(testDB); err != ErrUserExists {
+		t.Fatal("expected ErrUserExists, got", err)
+	}
+	u = &User{ID: u.ID + 100, Email: "v@example.com"}
+	if err = u.Update(testDB); err != ErrMissingUser {
+		t.Fatal("expected ErrMissingUser, got", err)
+	}
+}
+
+func TestChangeEmail(t *testing.T) {
+	u := &User{ID: 1, Email: "t@example.com"}
+	if err := u.ChangeEmail(nil, "t.example.com"); err != ErrInvalidEmail {
+		t.Fatal("expected ErrInvalidEmail, got", err)
+	}
+
+	requireDB(t)
+	u = seedUser(t, "t@example.com")
+	seedUser(t, "u@example.com")
+	if err := u.AddFlexID(testDB, u.Email, FIDTEmail); err != nil {
+		t.Fatal(err)
+	}
+	q := `UPDATE userflexids SET verified=TRUE WHERE userid=$1`
+	if _, err := testDB.Exec(q, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.ChangeEmail(testDB, "U@example.com"); err != ErrUserExists {
+		t.Fatal("expected ErrUserExists, got", err)
+	}
+	if u.Email != "t@example.com" {
+		t.Fatal("expected email to be unchanged, got", u.Email)
+	}
+
+	if err := u.ChangeEmail(testDB, "T2@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if u.Email != "T2@example.com" {
+		t.Fatal("expected email to be updated, got", u.Email)
+	}
+	got, err := GetUserByEmail(testDB, "t2@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != u.ID {
+		t.Fatal("expected user", u.ID, "got", got.ID)
+	}
+	var fids []struct {
+		FlexID   string
+		Verified bool
+	}
+	q = `SELECT flexid, verified FROM userflexids
+	     WHERE userid=$1 AND flexidtype=$2`
+	if err = testDB.Select(&fids, q, u.ID, FIDTEmail); err != nil {
+		t.Fatal(err)
+	}
+	if len(fids) != 1 || fids[0].FlexID != "t2@example.com" ||
+		fids[0].Verified {
+		t.Fatalf("expected one unverified t2@example.com flexid, got %+v",
+			fids)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	other := seedUser(t, "u@example.com")
+	for _, v := range []*User{u, other} {
+		if err := v.AddFlexID(testDB, v.Email, FIDTEmail); err != nil {
+			t.Fatal(err)
+		}
+		_, err := v.AddCard(testDB, &Card{
+			Last4:          "4242",
+			CardholderName: v.Name,
+			ExpMonth:       8,
+			ExpYear:        2030,
+			Brand:          "Visa",
+			ServiceToken:   "tok_" + v.Email,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := `INSERT INTO sessions (userid, token, label)
+		      VALUES ($1, 'token', 'csrfToken')`
+		if _, err = testDB.Exec(q, v.ID); err != nil {
+			t.Fatal(err)
+		}
+		q = `INSERT INTO preferences (userid, key, value)
+		     VALUES ($1, 'k', 'v')`
+		if _, err = testDB.Exec(q, v.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := u.Delete(testDB); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range userTables {
+		var count int
+		q := `SELECT COUNT(*) FROM ` + table + ` WHERE userid=$1`
+		if err := testDB.Get(&count, q, u.ID); err != nil {
+			t.Fatal(err)
+		}
+		if count > 0 {
+			t.Fatal("expected no rows in", table, "got", count)
+		}
+	}
+	if _, err := GetUserByEmail(testDB, u.Email); err != ErrMissingUser {
+		t.Fatal("expected ErrMissingUser, got", err)
+	}
+	if _, err := GetUserByEmail(testDB, other.Email); err != nil {
+		t.Fatal("expected other user to remain, got", err)
+	}
+	if err := u.Delete(testDB); err != ErrMissingUser {
+		t.Fatal("expected ErrMissingUser deleting twice, got", err)
+	}
+}
+
+func TestAnonymize(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	id := u.ID
+	if err := u.AddFlexID(testDB, "+13105555555", FIDTPhone); err != nil {
+		t.Fatal(err)
+	}
+	seedCard(t, u, "4242")
+	if _, err := u.CreateSession(testDB, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	q := `UPDATE users SET name='Alice', paymentserviceid='cus_1' WHERE id=$1`
+	if _, err := testDB.Exec(q, id); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Anonymize(testDB); err != nil {
+		t.Fatal(err)
+	}
+	if u.ID != id || u.Email == "t@example.com" || !u.Disabled {
+		t.Fatal("expected anonymized, disabled user", id, "got", u.ID,
+			u.Email, u.Disabled)
+	}
+	got, err := GetUserByPaymentServiceID(testDB, "cus_1")
+	if err != ErrMissingUser {
+		t.Fatal("expected payment service ID to be removed, got", got, err)
+	}
+	got, err = GetActiveUser(testDB, &Request{UserID: id})
+	if err != ErrUserDisabled {
+		t.Fatal("expected anonymized user to be disabled, got", err)
+	}
+	got, err = GetUser(testDB, &Request{UserID: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name == "Alice" || got.Email == "t@example.com" ||
+		!ValidEmail(got.Email) {
+		t.Fatal("expected name and email to be replaced, got", got.Name,
+			got.Email)
+	}
+	if _, err = GetUserByEmail(testDB, "t@example.com"); err != ErrMissingUser {
+		t.Fatal("expected email to be freed, got", err)
+	}
+	for _, table := range userTables {
+		var count int
+		q := `SELECT COUNT(*) FROM ` + table + ` WHERE userid=$1`
+		if err := testDB.Get(&count, q, id); err != nil {
+			t.Fatal(err)
+		}
+		if count > 0 {
+			t.Fatal("expected no rows in", table, "got", count)
+		}
+	}
+	entries, err := u.AuditLog(testDB, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatal("expected audit log to be kept, got", entries)
+	}
+}
+
+func TestMergeUsers(t *testing.T) {
+	requireDB(t)
+	keep := seedUser(t, "t@example.com")
+	merge := seedUser(t, "u@example.com")
+	for _, u := range []*User{keep, merge} {
+		err := u.AddFlexID(testDB, "+13105555555", FIDTPhone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := `INSERT INTO sessions (userid, token, label)
+		      VALUES ($1, $2, 'csrfToken')`
+		if _, err = testDB.Exec(q, u.ID, "tok_"+u.Email); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := merge.AddFlexID(testDB, merge.Email, FIDTEmail); err != nil {
+		t.Fatal(err)
+	}
+	err := merge.SetPrimaryFlexID(testDB, merge.Email, FIDTEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seedCard(t, keep, "4242")
+	seedCard(t, merge, "1111")
+	token, err := merge.CreateSession(testDB, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = MergeUsers(testDB, keep.ID, keep.ID); err != ErrMergeSelf {
+		t.Fatal("expected ErrMergeSelf, got", err)
+	}
+	if err = MergeUsers(testDB, keep.ID, merge.ID); err != nil {
+		t.Fatal(err)
+	}
+	_, err = GetUser(testDB, &Request{UserID: merge.ID})
+	if err != ErrMissingUser {
+		t.Fatal("expected merged user to be deleted, got", err)
+	}
+	cards, err := keep.GetCards(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cards) != 2 {
+		t.Fatal("expected 2 cards, got", len(cards))
+	}
+	fids, err := keep.ListFlexIDs(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fids) != 2 {
+		t.Fatal("expected phone and email flexids, got", fids)
+	}
+	for _, fid := range fids {
+		if fid.Type == FIDTEmail && !fid.Primary {
+			t.Fatal("expected merged email to remain primary")
+		}
+	}
+	u, err := GetSessionUser(testDB, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.ID != keep.ID {
+		t.Fatal("expected session to belong to", keep.ID, "got", u.ID)
+	}
+	var count int
+	q := `SELECT COUNT(*) FROM sessions WHERE userid=$1 AND label='csrfToken'`
+	if err = testDB.Get(&count, q, keep.ID); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatal("expected 1 csrfToken session, got", count)
+	}
+	if err = MergeUsers(testDB, keep.ID, merge.ID); err != ErrMissingUser {
+		t.Fatal("expected ErrMissingUser, got", err)
+	}
+}
+
+func TestGetPhone(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	if _, err := u.GetPhone(testDB); err != ErrMissingFlexID {
+		t.Fatal("expected ErrMissingFlexID, got", err)
+	}
+	if err := u.AddFlexID(testDB, u.Email, FIDTEmail); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := u.GetPhone(testDB); err != ErrMissingFlexID {
+		t.Fatal("expected ErrMissingFlexID with only an email, got", err)
+	}
+	for _, phone := range []string{"(310) 555-5555", "+1 310 555 5556"} {
+		code, err := u.StartPhoneVerification(testDB, phone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = u.ConfirmPhoneVerification(testDB, phone, code); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := u.AddFlexID(testDB, "+13105555557", FIDTPhone); err != nil {
+		t.Fatal(err)
+	}
+	phone, err := u.GetPhone(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if phone != "+13105555556" {
+		t.Fatal("expected newest verified phone +13105555556, got", phone)
+	}
+}
+
+func TestEmails(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	if err := u.AddFlexID(testDB, u.Email, FIDTEmail); err != nil {
+		t.Fatal(err)
+	}
+	emails, err := u.Emails(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(emails, []string{"t@example.com"}) {
+		t.Fatal("expected only t@example.com, got", emails)
+	}
+
+	for _, email := range []string{"work@example.com", "home@example.com",
+		"old@example.com", "unverified@example.com"} {
+		if err = u.AddFlexID(testDB, email, FIDTEmail); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	q := `UPDATE userflexids SET verified=TRUE
+	      WHERE userid=$1 AND flexid<>'unverified@example.com'`
+	if _, err = testDB.Exec(q, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	err = u.SetPrimaryFlexID(testDB, "old@example.com", FIDTEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emails, err = u.Emails(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"t@example.com", "old@example.com",
+		"home@example.com", "work@example.com"}
+	if !reflect.DeepEqual(emails, expected) {
+		t.Fatalf("expected %v, got %v", expected, emails)
+	}
+	if u.GetEmail() != emails[0] {
+		t.Fatal("expected GetEmail to return", emails[0], "got",
+			u.GetEmail())
+	}
+}
+
+func TestListFlexIDs(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	fids, err := u.ListFlexIDs(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fids) != 0 {
+		t.Fatal("expected no flexids, got", fids)
+	}
+	for _, fid := range []FlexID{
+		{Value: "+13105555555", Type: FIDTPhone},
+		{Value: u.Email, Type: FIDTEmail},
+		{Value: "+13105555556", Type: FIDTPhone},
+	} {
+		if err = u.AddFlexID(testDB, fid.Value, fid.Type); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	q := `UPDATE userflexids SET verified=TRUE WHERE userid=$1 AND flexid=$2`
+	if _, err = testDB.Exec(q, u.ID, "+13105555555"); err != nil {
+		t.Fatal(err)
+	}
+	fids, err = u.ListFlexIDs(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{u.Email, "+13105555556", "+13105555555"}
+	if len(fids) != len(expected) {
+		t.Fatal("expected", len(expected), "flexids, got", len(fids))
+	}
+	for i, fid := range fids {
+		if fid.Value != expected[i] {
+			t.Fatalf("expected flexid %d to be %s, got %s", i,
+				expected[i], fid.Value)
+		}
+		if fid.CreatedAt.IsZero() {
+			t.Fatal("expected createdat to be set")
+		}
+	}
+	if !fids[2].Verified || fids[1].Verified {
+		t.Fatal("expected only +13105555555 to be verified, got", fids)
+	}
+}
+
+func TestSetPrimaryFlexID(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	err := u.SetPrimaryFlexID(testDB, "+13105555555", FIDTPhone)
+	if err != ErrMissingFlexID {
+		t.Fatal("expected ErrMissingFlexID, got", err)
+	}
+	for _, phone := range []string{"+13105555555", "+13105555556"} {
+		if err = u.AddFlexID(testDB, phone, FIDTPhone); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	q := `UPDATE userflexids SET verified=TRUE WHERE userid=$1`
+	if _, err = testDB.Exec(q, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	phone, err := u.GetPhone(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if phone != "+13105555556" {
+		t.Fatal("expected newest phone without a primary, got", phone)
+	}
+	for _, primary := range []string{"(310) 555-5555", "+13105555556"} {
+		if err = u.SetPrimaryFlexID(testDB, primary, FIDTPhone); err != nil {
+			t.Fatal(err)
+		}
+		exp, _ := NormalizePhone(primary)
+		if phone, err = u.GetPhone(testDB); err != nil {
+			t.Fatal(err)
+		}
+		if phone != exp {
+			t.Fatal("expected primary phone", exp, "got", phone)
+		}
+		fids, err := u.ListFlexIDs(testDB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fids[0].Value != exp || !fids[0].Primary || fids[1].Primary {
+			t.Fatalf("expected only %s to be primary, got %+v", exp,
+				fids)
+		}
+	}
+}
+
+func TestGetUserMissing(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	_, err := GetUser(testDB, &Request{UserID: u.ID + 100})
+	if err != ErrMissingUser {
+		t.Fatal("expected ErrMissingUser, got", err)
+	}
+
+	// A dangling flexid pointing to a deleted user resolves to an
+	// unregistered user just like an unknown flexid.
+	if err = u.AddFlexID(testDB, "+13105555555", FIDTPhone); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = testDB.Exec(`DELETE FROM users WHERE id=$1`, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, fid := range []string{"+13105555555", "+13105555556"} {
+		req := &Request{FlexID: fid, FlexIDType: FIDTPhone}
+		got, err := GetUser(testDB, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != 0 || req.UserID != 0 {
+			t.Fatalf("%s: expected unregistered user, got %d", fid,
+				got.ID)
+		}
+		if got.FlexID != fid {
+			t.Fatalf("expected flexid %s, got %s", fid, got.FlexID)
+		}
+	}
+}
+
+func TestGetUserLoadsAllColumns(t *testing.T) {
+	requireDB(t)
+	seed := seedUser(t, "t@example.com")
+	if err := seed.AddFlexID(testDB, "+13105555555", FIDTPhone); err != nil {
+		t.Fatal(err)
+	}
+	q := `UPDATE users
+	      SET admin=TRUE, trainer=TRUE, paymentserviceid='cus_1'
+	      WHERE id=$1`
+	if _, err := testDB.Exec(q, seed.ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, req := range []*Request{
+		{UserID: seed.ID},
+		{FlexID: "+13105555555", FlexIDType: FIDTPhone},
+	} {
+		u, err := GetUser(testDB, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.ID != seed.ID || !u.Admin || !u.Trainer ||
+			u.PaymentServiceID != "cus_1" {
+			t.Fatalf("expected user %d with every column, got %d "+
+				"admin=%t trainer=%t %q", seed.ID, u.ID, u.Admin,
+				u.Trainer, u.PaymentServiceID)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	u.FlexID, u.FlexIDType = "+13105555555", FIDTPhone
+	q := `UPDATE users
+	      SET name='u', paymentserviceid='cus_1', trainer=TRUE
+	      WHERE id=$1`
+	if _, err := testDB.Exec(q, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Reload(testDB); err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "u" || u.PaymentServiceID != "cus_1" || !u.Trainer {
+		t.Fatalf("expected reloaded fields, got %q %q %t", u.Name,
+			u.PaymentServiceID, u.Trainer)
+	}
+	if u.FlexID != "+13105555555" || u.FlexIDType != FIDTPhone {
+		t.Fatalf("expected flexid to be kept, got %q %d", u.FlexID,
+			u.FlexIDType)
+	}
+	if _, err := testDB.Exec(`DELETE FROM users WHERE id=$1`, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Reload(testDB); err != ErrMissingUser {
+		t.Fatal("expected ErrMissingUser, got", err)
+	}
+}
+
+func TestGetUserPrefersVerified(t *testing.T) {
+	requireDB(t)
+	owner := seedUser(t, "t@example.com")
+	attacker := seedUser(t, "u@example.com")
+	const phone = "+13105555555"
+	code, err := owner.StartPhoneVerification(testDB, phone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = owner.ConfirmPhoneVerification(testDB, phone, code); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if err = attacker.AddFlexID(testDB, phone, FIDTPhone); err != nil {
+		t.Fatal(err)
+	}
+	u, err := GetUser(testDB, &Request{FlexID: phone, FlexIDType: FIDTPhone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.ID != owner.ID {
+		t.Fatal("expected verified owner", owner.ID, "got", u.ID)
+	}
+	users, err := GetUsersByFlexIDs(testDB, []FlexID{
+		{Value: phone, Type: FIDTPhone},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if users[phone] == nil || users[phone].ID != owner.ID {
+		t.Fatal("expected verified owner from GetUsersByFlexIDs, got",
+			users[phone])
+	}
+
+	// Without verification, the newest flexid wins.
+	q := `UPDATE userflexids SET verified=FALSE WHERE flexid=$1`
+	if _, err = testDB.Exec(q, phone); err != nil {
+		t.Fatal(err)
+	}
+	u, err = GetUser(testDB, &Request{FlexID: phone, FlexIDType: FIDTPhone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.ID != attacker.ID {
+		t.Fatal("expected newest user", attacker.ID, "got", u.ID)
+	}
+}
+
+func TestGetUsers(t *testing.T) {
+	requireDB(t)
+	u1 := seedUser(t, "t@example.com")
+	u2 := seedUser(t, "u@example.com")
+	missing := u2.ID + 100
+	users, err := GetUsers(testDB, []uint64{u1.ID, u2.ID, missing})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Fatal("expected 2 users, got", len(users))
+	}
+	if users[u1.ID].Email != u1.Email || users[u2.ID].Email != u2.Email {
+		t.Fatal("expected users mapped by id, got", users)
+	}
+	if _, ok := users[missing]; ok {
+		t.Fatal("expected missing id to be absent")
+	}
+	users, err = GetUsers(testDB, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 0 {
+		t.Fatal("expected no users, got", len(users))
+	}
+}
+
+// seedUsers inserts n users for benchmarks, returning their IDs.
+func TestGetUserByFlexID(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	for _, phone := range []string{"+13105551234", "+13105555678"} {
+		if err := u.AddFlexID(testDB, phone, FIDTPhone); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q := `UPDATE userflexids SET verified=TRUE WHERE userid=$1 AND flexid=$2`
+	if _, err := testDB.Exec(q, u.ID, "+13105555678"); err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]bool{
+		"(310) 555-1234": false,
+		"+13105555678":   true,
+	}
+	for phone, verified := range tests {
+		got, fid, err := GetUserByFlexID(testDB, FlexID{Value: phone})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != u.ID {
+			t.Fatalf("%s: expected user %d, got %d", phone, u.ID, got.ID)
+		}
+		if fid.Type != FIDTPhone || fid.Verified != verified {
+			t.Fatalf("%s: expected verified %t phone, got %d %t",
+				phone, verified, fid.Type, fid.Verified)
+		}
+	}
+
+	_, _, err := GetUserByFlexID(testDB, FlexID{Value: "+13105550000"})
+	if err != ErrMissingUser {
+		t.Fatal("expected ErrMissingUser, got", err)
+	}
+}
+
+func TestGetUsersByFlexIDs(t *testing.T) {
+	requireDB(t)
+	u1 := seedUser(t, "t@example.com")
+	u2 := seedUser(t, "u@example.com")
+	if err := u1.AddFlexID(testDB, "+13105555555", FIDTPhone); err != nil {
+		t.Fatal(err)
+	}
+	if err := u2.AddFlexID(testDB, "+13105555556", FIDTPhone); err != nil {
+		t.Fatal(err)
+	}
+	if err := u2.AddFlexID(testDB, u2.Email, FIDTEmail); err != nil {
+		t.Fatal(err)
+	}
+	fids := []FlexID{
+		{Value: "(310) 555-5555", Type: FIDTPhone},
+		{Value: "+13105555556", Type: FIDTPhone},
+		{Value: "+13105555557", Type: FIDTPhone},
+		{Value: "U@example.com", Type: FIDTEmail},
+		{Value: "+13105555556", Type: FIDTEmail + 10},
+	}
+	if _, err := GetUsersByFlexIDs(testDB, fids); err != ErrInvalidFlexIDType {
+		t.Fatal("expected ErrInvalidFlexIDType, got", err)
+	}
+	users, err := GetUsersByFlexIDs(testDB, fids[:4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]uint64{
+		"(310) 555-5555": u1.ID,
+		"+13105555556":   u2.ID,
+		"U@example.com":  u2.ID,
+	}
+	if len(users) != len(expected) {
+		t.Fatal("expected", len(expected), "users, got", len(users))
+	}
+	for fid, id := range expected {
+		if users[fid] == nil || users[fid].ID != id {
+			t.Fatalf("expected %s to resolve to user %d, got %+v", fid,
+				id, users[fid])
+		}
+	}
+	users, err = GetUsersByFlexIDs(testDB, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 0 {
+		t.Fatal("expected no users, got", len(users))
+	}
+}
+
+func seedUsersByPhone(b *testing.B, n int) []FlexID {
+	requireDB(b)
+	fids := make([]FlexID, n)
+	for i := range fids {
+		u := seedUser(b, fmt.Sprintf("t%d@example.com", i))
+		fids[i] = FlexID{
+			Value: fmt.Sprintf("+1310555%04d", i),
+			Type:  FIDTPhone,
+		}
+		if err := u.AddFlexID(testDB, fids[i].Value, FIDTPhone); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	return fids
+}
+
+func BenchmarkGetUsersByFlexIDs(b *testing.B) {
+	fids := seedUsersByPhone(b, 50)
+	for n := 0; n < b.N; n++ {
+		if _, err := GetUsersByFlexIDs(testDB, fids); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetUsersByFlexIDsLoop(b *testing.B) {
+	fids := seedUsersByPhone(b, 50)
+	for n := 0; n < b.N; n++ {
+		for _, fid := range fids {
+			req := &Request{FlexID: fid.Value, FlexIDType: fid.Type}
+			if _, err := GetUser(testDB, req); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func seedUsers(b *testing.B, n int) []uint64 {
+	requireDB(b)
+	ids := make([]uint64, n)
+	for i := range ids {
+		ids[i] = seedUser(b, fmt.Sprintf("t%d@example.com", i)).ID
+	}
+	b.ResetTimer()
+	return ids
+}
+
+func BenchmarkGetUsers(b *testing.B) {
+	ids := seedUsers(b, 50)
+	for n := 0; n < b.N; n++ {
+		if _, err := GetUsers(testDB, ids); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetUsersLoop(b *testing.B) {
+	ids := seedUsers(b, 50)
+	for n := 0; n < b.N; n++ {
+		for _, id := range ids {
+			if _, err := GetUser(testDB, &Request{UserID: id}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestSetDisabled(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	token, err := u.CreateSession(testDB, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = u.SetDisabled(testDB, true); err != nil {
+		t.Fatal(err)
+	}
+	if !u.Disabled {
+		t.Fatal("expected user to be disabled")
+	}
+	if _, err = GetSessionUser(testDB, token); err != ErrUserDisabled {
+		t.Fatal("expected disabled user to fail authentication, got", err)
+	}
+	req := &Request{UserID: u.ID}
+	if _, err = GetActiveUser(testDB, req); err != ErrUserDisabled {
+		t.Fatal("expected ErrUserDisabled, got", err)
+	}
+	got, err := GetUser(testDB, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Disabled {
+		t.Fatal("expected GetUser to return the disabled user")
+	}
+
+	if err = u.SetDisabled(testDB, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = GetSessionUser(testDB, token); err != nil {
+		t.Fatal("expected re-enabled user to authenticate, got", err)
+	}
+	if _, err = GetActiveUser(testDB, req); err != nil {
+		t.Fatal(err)
+	}
+	missing := &User{ID: u.ID + 100}
+	if err = missing.SetDisabled(testDB, true); err != ErrMissingUser {
+		t.Fatal("expected ErrMissingUser, got", err)
+	}
+}
+
+func TestSetPaymentServiceID(t *testing.T) {
+	requireDB(t)
+	u := seedUser(t, "t@example.com")
+	if err := u.SetPaymentServiceID(testDB, "cus_1"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := GetUser(testDB, &Request{UserID: u.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.PaymentServiceID != "cus_1" || got.PaymentServiceID != "cus_1" {
+		t.Fatalf("expected cus_1 to be saved, got %q %q",
+			u.PaymentServiceID, got.PaymentServiceID)
+	}
+	missing := &User{ID: u.ID + 100}
+	err = missing.SetPaymentServiceID(testDB, "cus_2")
+	if err != ErrMissingUser {
+		t.Fatal("expected ErrMissingUser, got", err)
+	}
+}
+
+func TestCountUsers(t *testing.T) {
+	requireDB(t)
+	for i, email := range []string{"t@example.com", "u@example.com",
+		"v@example.com"} {
+		u := seedUser(t, email)
+		if i > 0 {
+			if err := u.SetTrainer(testDB, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	n, err := CountUsers(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatal("expected 3 users, got", n)
+	}
+	if n, err = CountTrainers(testDB); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatal("expected 2 trainers, got", n)
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	tests := map[string]string{
+		"ann": "ann",
+		"50%": `50\%`,
+		"a_b": `a\_b`,
+		`a\b`: `a\\b`,
+		`%_\`: `\%\_\\`,
+		"":    "",
+	}
+	for in, want := range tests {
+		if got := escapeLike(in); got != want {
+			t.Fatalf("%q: expected %q, got %q", in, want, got)
+		}
+	}
+}
+
+func TestSearchUsersByName(t *testing.T) {
+	requireDB(t)
+	names := []string{"Annie", "ann", "Bob", "50% Off", "5000", "a_b", "axb"}
+	for i, name := range names {
+		u := seedUser(t, fmt.Sprintf("t%d@example.com", i))
+		q := `UPDATE users SET name=$1 WHERE id=$2`
+		if _, err := testDB.Exec(q, name, u.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := map[string][]string{
+		"ann":    {"ann", "Annie"},
+		"ANN":    {"ann", "Annie"},
+		"50%":    {"50% Off"},
+		"a_":     {"a_b"},
+		"nobody": {},
+	}
+	for prefix, want := range tests {
+		users, err := SearchUsersByName(testDB, prefix, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if users == nil || len(users) != len(want) {
+			t.Fatalf("%q: expected %v, got %v", prefix, want, users)
+		}
+		for i, u := range users {
+			if u.Name != want[i] {
+				t.Fatalf("%q: expected %v, got %v", prefix, want,
+					users)
+			}
+		}
+	}
+
+	users, err := SearchUsersByName(testDB, "a", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 {
+		t.Fatal("expected limit of 1, got", len(users))
+	}
+	if _, err = SearchUsersByName(testDB, "a", 0); err != ErrInvalidPage {
+		t.Fatal("expected ErrInvalidPage, got", err)
+	}
+}
+
+func TestListTrainers(t *testing.T) {
+	requireDB(t)
+	var trainers []*User
+	for _, email := range []string{"t@example.com", "u@example.com",
+		"v@example.com"} {
+		u := seedUser(t, email)
+		if email != "u@example.com" {
+			if err := u.SetTrainer(testDB, true); err != nil {
+				t.Fatal(err)
+			}
+			trainers = append(trainers, u)
+		}
+	}
+	users, err := ListTrainers(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != len(trainers) {
+		t.Fatal("expected", len(trainers), "trainers, got", len(users))
+	}
+	for i, u := range users {
+		if u.ID != trainers[i].ID || !u.Trainer {
+			t.Fatal("expected trainer", trainers[i].ID, "got", u.ID)
+		}
+	}
+
+	if err = trainers[0].SetTrainer(testDB, false); err != nil {
+		t.Fatal(err)
+	}
+	if trainers[0].Trainer {
+		t.Fatal("expected Trainer to be updated")
+	}
+	users, err = ListTrainers(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].ID != trainers[1].ID {
+		t.Fatal("expected only", trainers[1].ID, "got", users)
+	}
+}
+
+func TestUserString(t *testing.T) {
+	u := &User{ID: 12, Name: "Alice", Email: "alice@example.com"}
+	if s := u.String(); s != "User#12 Alice" {
+		t.Fatal("expected User#12 Alice, got", s)
+	}
+	for _, v := range []interface{}{u, *u} {
+		for _, verb := range []string{"%s", "%v", "%+v"} {
+			s := fmt.Sprintf(verb, v)
+			if s != "User#12 Alice" {
+				t.Fatalf("%s of %T: expected User#12 Alice, got %s",
+					verb, v, s)
+			}
+		}
+	}
+}
+
+func TestUserMarshalJSON(t *testing.T) {
+	u := User{
+		ID:                12,
+		Name:              "Alice",
+		Email:             "alice@example.com",
+		Password:          "pw_secret",
+		FlexID:            "+13105555555",
+		FlexIDType:        FIDTPhone,
+		PaymentServiceID:  "cus_secret",
+		ContactPreference: ContactSMS,
+	}
+	for _, v := range []interface{}{u, &u, []*User{&u}} {
+		byt, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := string(byt)
+		if strings.Contains(s, "cus_secret") ||
+			strings.Contains(s, "PaymentServiceID") ||
+			strings.Contains(s, "pw_secret") ||
+			strings.Contains(s, "alice@") ||
+			strings.Contains(s, "3105555555") {
+			t.Fatal("expected personal information to be redacted, got", s)
+		}
+		if !strings.Contains(s, `"Email":"a***@example.com"`) ||
+			!strings.Contains(s, `"FlexID":"***5555"`) ||
+			!strings.Contains(s, `"ContactPreference":2`) {
+			t.Fatal("expected masked email and flexid, got", s)
+		}
+	}
+
+	byt, err := u.MarshalJSONFull()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(byt)
+	for _, exp := range []string{`"Email":"alice@example.com"`,
+		`"FlexID":"+13105555555"`, `"PaymentServiceID":"cus_secret"`,
+		`"ContactPreference":2`} {
+		if !strings.Contains(s, exp) {
+			t.Fatalf("expected %s in full output, got %s", exp, s)
+		}
+	}
+	if strings.Contains(s, "pw_secret") {
+		t.Fatal("expected password to be omitted, got", s)
+	}
+}
+
+func TestMaskEmail(t *testing.T) {
+	tests := map[string]string{
+		"alice@example.com": "a***@example.com",
+		"a@example.com":     "a***@example.com",
+		"@example.com":      "***",
+		"alice":             "***",
+		"":                  "",
+	}
+	for in, exp := range tests {
+		if got := maskEmail(in); got != exp {
+			t.Fatalf("%q: expected %q, got %q", in, exp, got)
+		}
+	}
+}
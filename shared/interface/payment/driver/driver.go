@@ -27,7 +27,8 @@ type Conn interface {
 	// its 3-letter ISO code.
 	ChargeCard(cardID uint64, amountInCents uint64, isoCurrency string) error
 
-	// RegisterUser on the external payment service.
+	// RegisterUser on the external payment service, setting the user's
+	// PaymentServiceID to their new customer ID.
 	RegisterUser(user *dt.User) error
 
 	// Close the connection.
@@ -5,15 +5,21 @@
 package payment
 
 import (
+	"errors"
 	"fmt"
 	"sort"
 	"sync"
 
+	"github.com/itsabot/abot/shared/datatypes"
 	"github.com/itsabot/abot/shared/interface/payment/driver"
 	"github.com/jmoiron/sqlx"
 	"github.com/julienschmidt/httprouter"
 )
 
+// ErrMissingPaymentServiceID is returned by RegisterUser when the driver
+// registers a user without setting their PaymentServiceID.
+var ErrMissingPaymentServiceID = errors.New("driver didn't set PaymentServiceID")
+
 var driversMu sync.RWMutex
 var drivers = make(map[string]driver.Driver)
 
@@ -47,6 +53,7 @@ func Drivers() []string {
 type Conn struct {
 	driver driver.Driver
 	conn   driver.Conn
+	db     dt.Queryer
 }
 
 // Open a connection to a registered driver.
@@ -67,10 +74,31 @@ func Open(driverName string, db *sqlx.DB, r *httprouter.Router,
 	c := &Conn{
 		driver: driveri,
 		conn:   conn,
+		db:     db,
 	}
 	return c, nil
 }
 
+// RegisterUser on the external payment service through the opened driver
+// connection, saving the PaymentServiceID set by the driver. Users who already
+// have a PaymentServiceID are already registered, so this is a no-op for them,
+// making it safe to call before every purchase.
+func (c *Conn) RegisterUser(u *dt.User) error {
+	if u.PaymentServiceID != "" {
+		return nil
+	}
+	if err := c.conn.RegisterUser(u); err != nil {
+		return err
+	}
+	if u.PaymentServiceID == "" {
+		return ErrMissingPaymentServiceID
+	}
+	if err := u.SetPaymentServiceID(c.db, u.PaymentServiceID); err != nil {
+		return fmt.Errorf("save payment service id: %s", err)
+	}
+	return nil
+}
+
 // Driver returns the driver used by a connection.
 func (c *Conn) Driver() driver.Driver {
 	return c.driver
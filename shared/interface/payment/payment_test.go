@@ -0,0 +1,95 @@
+package payment
+
+import (
+	"database/sql"
+	sqldriver "database/sql/driver"
+	"errors"
+	"testing"
+
+	"github.com/itsabot/abot/shared/datatypes"
+	"github.com/itsabot/abot/shared/interface/payment/driver"
+	"github.com/jmoiron/sqlx"
+	"github.com/julienschmidt/httprouter"
+)
+
+// fakeDriver opens fakeConns, which register users with a fixed customer ID
+// unless err is set.
+type fakeDriver struct{ conn *fakeConn }
+
+func (d *fakeDriver) Open(db *sqlx.DB, r *httprouter.Router,
+	name string) (driver.Conn, error) {
+	return d.conn, nil
+}
+
+type fakeConn struct {
+	registered int
+	err        error
+}
+
+func (c *fakeConn) SaveCard(params *dt.CardParams, u *dt.User) (uint64,
+	error) {
+	return 0, nil
+}
+
+func (c *fakeConn) ChargeCard(cardID uint64, amountInCents uint64,
+	isoCurrency string) error {
+	return nil
+}
+
+func (c *fakeConn) RegisterUser(u *dt.User) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.registered++
+	u.PaymentServiceID = "cus_1"
+	return nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+// fakeDB records the payment service IDs saved by RegisterUser.
+type fakeDB struct {
+	dt.Queryer
+	saved map[uint64]string
+}
+
+func (db *fakeDB) Exec(q string, args ...interface{}) (sql.Result, error) {
+	db.saved[args[1].(uint64)] = args[0].(string)
+	return sqldriver.RowsAffected(1), nil
+}
+
+func TestRegisterUser(t *testing.T) {
+	fc := &fakeConn{}
+	Register("fake", &fakeDriver{conn: fc})
+	c, err := Open("fake", nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &fakeDB{saved: map[uint64]string{}}
+	c.db = db
+
+	u := &dt.User{ID: 1}
+	if err = c.RegisterUser(u); err != nil {
+		t.Fatal(err)
+	}
+	if u.PaymentServiceID != "cus_1" || fc.registered != 1 {
+		t.Fatal("expected user to be registered, got",
+			u.PaymentServiceID, fc.registered)
+	}
+	if db.saved[1] != "cus_1" {
+		t.Fatal("expected cus_1 to be saved, got", db.saved)
+	}
+
+	// Registering again is a no-op
+	if err = c.RegisterUser(u); err != nil {
+		t.Fatal(err)
+	}
+	if fc.registered != 1 {
+		t.Fatal("expected no second registration, got", fc.registered)
+	}
+
+	fc.err = errors.New("payment service unavailable")
+	if err = c.RegisterUser(&dt.User{ID: 2}); err != fc.err {
+		t.Fatal("expected payment service error, got", err)
+	}
+}
@@ -8,6 +8,26 @@ import (
 	"github.com/itsabot/abot/shared/language"
 )
 
+// AddressLabels maps words a user might use to describe an address to the
+// canonical name under which the address is saved. Plugins can register
+// synonyms before the task runs, e.g. AddressLabels["apartment"] = "home".
+var AddressLabels = map[string]string{
+	"home":   "home",
+	"office": "office",
+	"work":   "office",
+}
+
+// addressLabel returns the canonical name of the first word in the sentence
+// found in AddressLabels, or an empty string if none match.
+func addressLabel(sentence string) string {
+	for _, w := range strings.Fields(strings.ToLower(sentence)) {
+		if label, ok := AddressLabels[strings.Trim(w, ".,!?'\"")]; ok {
+			return label
+		}
+	}
+	return ""
+}
+
 func getAddress(p *dt.Plugin, label string) []dt.State {
 	return []dt.State{
 		{
@@ -38,18 +58,7 @@ func getAddress(p *dt.Plugin, label string) []dt.State {
 			},
 			// TODO consider returning an error message here...
 			OnInput: func(in *dt.Msg) {
-				var location string
-				tmp := strings.Fields(strings.ToLower(
-					in.Sentence))
-				for _, w := range tmp {
-					if w == "home" {
-						location = w
-						break
-					} else if w == "office" || w == "work" {
-						location = "office"
-						break
-					}
-				}
+				location := addressLabel(in.Sentence)
 				mem := p.GetMemory(in, "shipping_address")
 				var addr *dt.Address
 				err := json.Unmarshal(mem.Val, addr)
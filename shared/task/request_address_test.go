@@ -0,0 +1,26 @@
+package task
+
+import "testing"
+
+func TestAddressLabel(t *testing.T) {
+	tests := map[string]string{
+		"That's my home":         "home",
+		"It's my office.":        "office",
+		"work":                   "office",
+		"my apartment downtown":  "",
+		"my apartment, downtown": "",
+	}
+	for sentence, expected := range tests {
+		if label := addressLabel(sentence); label != expected {
+			t.Fatalf("%q: expected %q, got %q", sentence, expected,
+				label)
+		}
+	}
+
+	AddressLabels["apartment"] = "home"
+	defer delete(AddressLabels, "apartment")
+	if label := addressLabel("my apartment downtown"); label != "home" {
+		t.Fatalf("expected registered synonym to map to home, got %q",
+			label)
+	}
+}